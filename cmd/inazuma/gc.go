@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/config"
+	"github.com/52poke/inazuma/internal/gc"
+	"github.com/52poke/inazuma/internal/lock"
+	"github.com/52poke/inazuma/internal/ttl"
+)
+
+// collectGarbage runs one GC pass over the bucket.
+func collectGarbage(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	_ = fs.Parse(args)
+
+	store, err := newStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err := newTTLRules(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redisClient, err := newRedisClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collector := newCollector(cfg, store, newLocker(cfg, redisClient), rules)
+	collector.DryRun = *dryRun
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	res, err := collector.RunExclusive(ctx)
+	log.Printf("gc: scanned=%d deleted=%d reclaimed=%d bytes in %s",
+		res.Scanned, res.Deleted, res.BytesReclaimed, res.Duration.Round(time.Millisecond))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newCollector collects objects older than INAZUMA_GC_EXPIRY_MULTIPLE times
+// their TTL. Keys the title cannot be recovered from get the longest TTL.
+func newCollector(cfg config.Config, store cache.Store, locker lock.Locker, rules *ttl.Rules) *gc.Collector {
+	multiple := time.Duration(cfg.GCExpiryMultiple)
+	return &gc.Collector{
+		Cache: store,
+		Locks: locker,
+		MaxAgeFor: func(key string) time.Duration {
+			if variant, title, ok := cache.ParsePageKey(key); ok {
+				return multiple * rules.TTL(variant, title)
+			}
+			return multiple * rules.Max()
+		},
+	}
+}
@@ -2,20 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/52poke/inazuma/internal/admin"
 	"github.com/52poke/inazuma/internal/cache"
 	"github.com/52poke/inazuma/internal/config"
 	"github.com/52poke/inazuma/internal/http"
 	"github.com/52poke/inazuma/internal/lock"
+	"github.com/52poke/inazuma/internal/metrics"
 	"github.com/52poke/inazuma/internal/mw"
 	"github.com/52poke/inazuma/internal/purge"
+	"github.com/52poke/inazuma/internal/ttl"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/redis/go-redis/v9"
 )
 
 const methodPurge = "PURGE"
@@ -26,33 +32,79 @@ func main() {
 		log.Fatal(err)
 	}
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
-		awsconfig.WithRegion(cfg.S3Region),
-		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.S3AccessKey, cfg.S3SecretKey, "")),
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1], os.Args[2:])
+		return
+	}
+	serve(cfg)
+}
+
+func runCommand(cfg config.Config, name string, args []string) {
+	switch name {
+	case "serve":
+		serve(cfg)
+	case "migrate-keys":
+		migrateKeys(cfg, args)
+	case "gc":
+		collectGarbage(cfg, args)
+	default:
+		log.Fatalf("unknown command %q", name)
+	}
+}
+
+func serve(cfg config.Config) {
+	store, err := newStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err := newTTLRules(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	breaker := cache.NewBreakerStore(store, cfg.CacheBackend,
+		cfg.BreakerFailures,
+		time.Duration(cfg.BreakerSlowMillis)*time.Millisecond,
+		time.Duration(cfg.BreakerCooldown)*time.Second,
 	)
+	store = breaker
+	if cfg.MemoryCacheBytes > 0 {
+		store = cache.NewTieredStore(store, cfg.MemoryCacheBytes,
+			time.Duration(cfg.MemoryCacheTTL)*time.Second,
+			rules.Max(),
+		)
+	}
+	redisClient, err := newRedisClient(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	locker := newLocker(cfg, redisClient)
+	fills := newNotifier(cfg, redisClient)
+	mwClient := mw.NewClient(cfg.MediaWikiBaseURL, time.Duration(cfg.MediaWikiTimeoutSeconds)*time.Second)
 
-	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-		o.BaseEndpoint = aws.String(cfg.S3Endpoint)
-	})
-	store := cache.NewS3Store(cfg.S3Bucket, s3Client)
-	redisClient := lock.NewRedisClient(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
-	mwClient := mw.NewClient(cfg.MediaWikiBaseURL)
-
-	handler, err := httpx.NewHandler(cfg, store, mwClient, redisClient)
+	handler, err := httpx.NewHandler(cfg, store, mwClient, locker)
 	if err != nil {
 		log.Fatal(err)
 	}
+	handler.TTL = rules
+	handler.Fills = fills
+	handler.Refreshes = newSemaphore(cfg, redisClient)
 
 	purgeHandler := &purge.Handler{
 		Cache:      store,
 		MW:         mwClient,
-		Redis:      redisClient,
+		Locks:      locker,
 		NginxPurge: cfg.NginxPurgeURL,
 		LockTTL:    time.Duration(cfg.LockTTLSeconds) * time.Second,
+		Encoding:   cfg.StorageEncoding,
+		Headers:    cfg.CacheHeaders,
+		TTL:        rules,
+		DefaultTTL: time.Duration(cfg.CacheTTLSeconds) * time.Second,
+		Fills:      fills,
+	}
+
+	if cfg.GCIntervalSeconds > 0 {
+		collector := newCollector(cfg, store, locker, rules)
+		go collector.Loop(context.Background(), time.Duration(cfg.GCIntervalSeconds)*time.Second)
 	}
 
 	mux := http.NewServeMux()
@@ -60,8 +112,19 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 	})
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		// Pages are proxied while the breaker is open, so it does not make the
+		// instance unready.
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"status":        "ok",
+			"cache_breaker": breaker.State(),
+		})
 	})
+	mux.Handle("/metrics", metrics.Handler())
+	if cfg.AdminToken != "" {
+		mux.Handle("/admin/", admin.NewHandler(store, purgeHandler, cfg.AdminToken))
+	}
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == methodPurge {
 			purgeHandler.ServeHTTP(w, r)
@@ -83,3 +146,119 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func newStore(cfg config.Config) (cache.Store, error) {
+	var store cache.Store
+	var err error
+	if cfg.CacheBackend == config.BackendDisk {
+		store, err = cache.NewDiskStore(cfg.DiskCacheDir)
+	} else {
+		store, err = newS3Store(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store = cache.NewInstrumentedStore(store, cfg.CacheBackend)
+	if cfg.HasMirror() {
+		if store, err = newMirrorStore(cfg, store); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.KeyPrefix != "" {
+		store = cache.NewPrefixStore(store, cfg.KeyPrefix)
+	}
+	if len(cfg.EncryptionKeys) > 0 {
+		encrypted, err := cache.NewEncryptedStore(store, cfg.EncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		store = encrypted
+	}
+	return store, nil
+}
+
+func newMirrorStore(cfg config.Config, primary cache.Store) (cache.Store, error) {
+	var secondaries []cache.Store
+	if cfg.MirrorS3Endpoint != "" {
+		mirror, err := openS3Store(cfg.MirrorS3Endpoint, cfg.MirrorS3Region, cfg.MirrorS3Bucket, cfg.MirrorS3AccessKey, cfg.MirrorS3SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		secondaries = append(secondaries, cache.NewInstrumentedStore(mirror, "mirror-"+config.BackendS3))
+	}
+	if cfg.MirrorDiskDir != "" {
+		mirror, err := cache.NewDiskStore(cfg.MirrorDiskDir)
+		if err != nil {
+			return nil, err
+		}
+		secondaries = append(secondaries, cache.NewInstrumentedStore(mirror, "mirror-"+config.BackendDisk))
+	}
+	return cache.NewMirrorStore(primary, secondaries, cfg.MirrorMode == config.MirrorAsync, cfg.MirrorBackfill), nil
+}
+
+// newTTLRules loads INAZUMA_TTL_RULES_FILE, falling back to the global TTL
+// for pages no rule matches.
+func newTTLRules(cfg config.Config) (*ttl.Rules, error) {
+	def := time.Duration(cfg.CacheTTLSeconds) * time.Second
+	if cfg.TTLRulesFile == "" {
+		return ttl.New(nil, def)
+	}
+	return ttl.Load(cfg.TTLRulesFile, def)
+}
+
+// newLocker falls back to an in-process locker when redisClient is nil.
+func newLocker(cfg config.Config, redisClient redis.UniversalClient) lock.Locker {
+	var locker lock.Locker = lock.NewLocalLocker()
+	if redisClient != nil {
+		locker = lock.NewRedisLocker(redisClient)
+	}
+	if cfg.KeyPrefix != "" {
+		locker = lock.NewPrefixLocker(locker, cfg.KeyPrefix)
+	}
+	return locker
+}
+
+// newSemaphore mirrors newLocker.
+func newSemaphore(cfg config.Config, redisClient redis.UniversalClient) lock.Semaphore {
+	var sem lock.Semaphore = lock.NewLocalSemaphore()
+	if redisClient != nil {
+		sem = lock.NewRedisSemaphore(redisClient)
+	}
+	if cfg.KeyPrefix != "" {
+		sem = lock.NewPrefixSemaphore(sem, cfg.KeyPrefix)
+	}
+	return sem
+}
+
+// newNotifier shares the lock backend, using a channel of its own per
+// INAZUMA_KEY_PREFIX.
+func newNotifier(cfg config.Config, redisClient redis.UniversalClient) lock.Notifier {
+	if redisClient == nil {
+		return lock.NewLocalNotifier()
+	}
+	channel := "fills"
+	if cfg.KeyPrefix != "" {
+		channel = cfg.KeyPrefix + ":" + channel
+	}
+	return lock.NewRedisNotifier(redisClient, channel)
+}
+
+func newS3Store(cfg config.Config) (*cache.S3Store, error) {
+	return openS3Store(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey)
+}
+
+func openS3Store(endpoint, region, bucket, accessKey, secretKey string) (*cache.S3Store, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
+		awsconfig.WithRegion(region),
+		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = true
+		o.BaseEndpoint = aws.String(endpoint)
+	})
+	return cache.NewS3Store(bucket, s3Client), nil
+}
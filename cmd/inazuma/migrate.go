@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/config"
+)
+
+// migrateKeys copies objects from the legacy key layout to the current one.
+func migrateKeys(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	deleteOld := fs.Bool("delete", false, "delete legacy objects once migrated")
+	dryRun := fs.Bool("dry-run", false, "only report what would change")
+	workers := fs.Int("workers", 8, "number of objects migrated concurrently")
+	_ = fs.Parse(args)
+
+	if cfg.CacheBackend != config.BackendS3 {
+		log.Fatal("migrate-keys requires the s3 backend")
+	}
+	store, err := newS3Store(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := store.MigrateKeys(ctx, cache.MigrateOptions{
+		Delete:    *deleteOld,
+		DryRun:    *dryRun,
+		Workers:   *workers,
+		KeyPrefix: cfg.KeyPrefix,
+		Progress: func(s cache.MigrateStats) {
+			if s.Scanned%1000 == 0 {
+				log.Printf("migrate-keys: scanned=%d copied=%d skipped=%d deleted=%d", s.Scanned, s.Copied, s.Skipped, s.Deleted)
+			}
+		},
+	})
+	log.Printf("migrate-keys: done scanned=%d copied=%d skipped=%d deleted=%d invalid=%d",
+		stats.Scanned, stats.Copied, stats.Skipped, stats.Deleted, stats.Invalid)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
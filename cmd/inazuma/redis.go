@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	"github.com/52poke/inazuma/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient returns nil unless the redis lock backend is configured. The
+// client talks to a single node, the master behind Sentinel or a cluster,
+// depending on INAZUMA_REDIS_MODE.
+func newRedisClient(cfg config.Config) (redis.UniversalClient, error) {
+	if cfg.LockBackend != config.LockRedis {
+		return nil, nil
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:         cfg.RedisAddrs,
+		DB:            cfg.RedisDB,
+		Username:      cfg.RedisUsername,
+		Password:      cfg.RedisPassword,
+		IsClusterMode: cfg.RedisMode == config.RedisCluster,
+	}
+	if cfg.RedisMode == config.RedisSentinel {
+		opts.MasterName = cfg.RedisMasterName
+		opts.SentinelUsername = cfg.RedisSentinelUsername
+		opts.SentinelPassword = cfg.RedisSentinelPassword
+	}
+	if cfg.RedisTLS {
+		tlsConfig, err := newRedisTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return redis.NewUniversalClient(opts), nil
+}
+
+func newRedisTLSConfig(cfg config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.RedisTLSServerName,
+	}
+	if cfg.RedisTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("INAZUMA_REDIS_TLS_CA_FILE contains no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
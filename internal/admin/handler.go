@@ -0,0 +1,226 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	httpx "github.com/52poke/inazuma/internal/http"
+	"github.com/52poke/inazuma/internal/lang"
+	"github.com/52poke/inazuma/internal/purge"
+	"github.com/52poke/inazuma/internal/ttl"
+)
+
+// Handler serves the admin API under /admin/. Every request must carry the
+// configured token as a bearer token.
+type Handler struct {
+	Cache cache.Store
+	Purge *purge.Handler
+	Token string
+
+	mux *http.ServeMux
+}
+
+type entryJSON struct {
+	Key        string    `json:"key"`
+	Variant    string    `json:"variant,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Size       int64     `json:"size"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+	// TTLSeconds is the TTL recorded when the page was stored. Only title
+	// lookups, which read each object's metadata, report it.
+	TTLSeconds *int64 `json:"ttl_seconds,omitempty"`
+}
+
+type listJSON struct {
+	Entries []entryJSON `json:"entries"`
+	Cursor  string      `json:"cursor,omitempty"`
+}
+
+const defaultListLimit = 100
+
+var variants = []string{lang.VariantZH, lang.VariantHans, lang.VariantHant}
+
+func NewHandler(store cache.Store, purger *purge.Handler, token string) *Handler {
+	h := &Handler{Cache: store, Purge: purger, Token: token, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /admin/cache", h.listCache)
+	h.mux.HandleFunc("POST /admin/purge", h.bulkPurge)
+	h.mux.HandleFunc("GET /admin/purge/{id}", h.purgeJob)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+// listCache lists cached objects. With title it looks up that page in every
+// variant (or the given one); otherwise it pages through keys starting with
+// prefix, or with the key prefix of variant and title_prefix.
+func (h *Handler) listCache(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if title := q.Get("title"); title != "" {
+		h.lookupTitle(w, r, httpx.NormalizeTitle(title), q.Get("variant"))
+		return
+	}
+
+	prefix := q.Get("prefix")
+	if titlePrefix := q.Get("title_prefix"); titlePrefix != "" {
+		variant := q.Get("variant")
+		if variant == "" {
+			http.Error(w, "variant is required with title_prefix", http.StatusBadRequest)
+			return
+		}
+		prefix = cache.PageKeyPrefix(variant, strings.ReplaceAll(titlePrefix, " ", "_"))
+	}
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	page, err := cache.List(r.Context(), h.Cache, cache.ListOptions{
+		Prefix: prefix,
+		Cursor: q.Get("cursor"),
+		Limit:  limit,
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	out := listJSON{Entries: make([]entryJSON, 0, len(page.Entries)), Cursor: page.Cursor}
+	for _, entry := range page.Entries {
+		out.Entries = append(out.Entries, newEntryJSON(entry))
+	}
+	writeJSON(w, out)
+}
+
+func (h *Handler) lookupTitle(w http.ResponseWriter, r *http.Request, title, variant string) {
+	lookup := variants
+	if variant != "" {
+		lookup = []string{variant}
+	}
+	out := listJSON{Entries: []entryJSON{}}
+	for _, v := range lookup {
+		key := cache.PageKey(v, title)
+		obj, err := h.Cache.Head(r.Context(), key)
+		if errors.Is(err, cache.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		entry := newEntryJSON(cache.Entry{
+			Key:       key,
+			Size:      obj.Size,
+			UpdatedAt: obj.UpdatedAt,
+		})
+		if d, ok := ttl.ParseMeta(obj.Meta); ok {
+			seconds := int64(d / time.Second)
+			entry.TTLSeconds = &seconds
+		}
+		out.Entries = append(out.Entries, entry)
+	}
+	writeJSON(w, out)
+}
+
+// bulkPurge deletes every object under a key prefix, title prefix or
+// namespace. With async=1 it answers 202 with a job to poll instead of
+// waiting for the purge to finish.
+func (h *Handler) bulkPurge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := purge.BulkRequest{
+		KeyPrefix:   q.Get("key_prefix"),
+		TitlePrefix: strings.ReplaceAll(q.Get("title_prefix"), " ", "_"),
+		Namespace:   strings.ReplaceAll(q.Get("namespace"), " ", "_"),
+		Variants:    q["variant"],
+	}
+
+	if q.Get("async") == "1" {
+		job, err := h.Purge.StartBulk(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/admin/purge/"+job.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	if _, err := req.Prefixes(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := h.Purge.Bulk(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if job.State == purge.JobFailed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(job)
+		return
+	}
+	writeJSON(w, job)
+}
+
+func (h *Handler) purgeJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.Purge.Job(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, job)
+}
+
+func newEntryJSON(entry cache.Entry) entryJSON {
+	out := entryJSON{
+		Key:       entry.Key,
+		Size:      entry.Size,
+		UpdatedAt: entry.UpdatedAt.UTC(),
+	}
+	if !entry.UpdatedAt.IsZero() {
+		out.AgeSeconds = int64(time.Since(entry.UpdatedAt).Seconds())
+	}
+	out.Variant, out.Title, _ = cache.ParsePageKey(entry.Key)
+	return out
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "cache backend does not support listing", http.StatusNotImplemented)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
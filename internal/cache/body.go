@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// sizedReader fails with io.ErrUnexpectedEOF when the underlying reader ends
+// before size bytes were read, so a truncated body is never committed. A
+// negative size disables the check.
+type sizedReader struct {
+	r    io.Reader
+	size int64
+	n    int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err == io.EOF && s.size >= 0 && s.n != s.size {
+		return n, fmt.Errorf("read %d of %d bytes: %w", s.n, s.size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// hashingReader hashes everything read through it so stores can derive
+// content validators while streaming a body.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	return n, err
+}
+
+// ETag returns the content hash of the bytes read so far.
+func (h *hashingReader) ETag() string {
+	return hex.EncodeToString(h.h.Sum(nil)[:16])
+}
+
+// Checksum returns the hex SHA-256 of the bytes read so far.
+func (h *hashingReader) Checksum() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+// verifyBody makes reading obj.Body fail with ErrCorrupted at the end when
+// the body does not match obj.Checksum. Objects stored without a checksum are
+// returned unchanged.
+func verifyBody(obj Object) Object {
+	if obj.Checksum == "" || obj.Body == nil {
+		return obj
+	}
+	obj.Body = readCloser{
+		Reader: &verifyingReader{r: newHashingReader(obj.Body), want: obj.Checksum},
+		Closer: obj.Body,
+	}
+	return obj
+}
+
+type verifyingReader struct {
+	r    *hashingReader
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF && v.r.Checksum() != v.want {
+		return n, fmt.Errorf("%w: sha256 %s, want %s", ErrCorrupted, v.r.Checksum(), v.want)
+	}
+	return n, err
+}
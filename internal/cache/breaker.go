@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/52poke/inazuma/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without calling the wrapped Store while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("cache store circuit breaker is open")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerHalfOpen = "half-open"
+	BreakerOpen     = "open"
+)
+
+// BreakerStore stops calling a failing Store. It opens after a run of
+// consecutive failures, where calls slower than the latency threshold count
+// as failures too. Once the cooldown has passed it lets a single probe
+// through and closes again if the probe succeeds.
+type BreakerStore struct {
+	next     Store
+	backend  string
+	failures int
+	slow     time.Duration
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+// NewBreakerStore wraps next. A failures threshold of zero never opens the
+// breaker and a zero slow threshold disables the latency check.
+func NewBreakerStore(next Store, backend string, failures int, slow, cooldown time.Duration) *BreakerStore {
+	b := &BreakerStore{
+		next:     next,
+		backend:  backend,
+		failures: failures,
+		slow:     slow,
+		cooldown: cooldown,
+		state:    BreakerClosed,
+	}
+	b.setGauge(BreakerClosed)
+	return b
+}
+
+// State reports the breaker state, moving from open to half-open once the
+// cooldown has passed.
+func (b *BreakerStore) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.transition(BreakerHalfOpen)
+	}
+	return b.state
+}
+
+func (b *BreakerStore) Get(ctx context.Context, key string) (Object, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return Object{}, err
+	}
+	start := time.Now()
+	obj, err := b.next.Get(ctx, key)
+	b.record(start, err, true, probe)
+	return obj, err
+}
+
+func (b *BreakerStore) Head(ctx context.Context, key string) (Object, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return Object{}, err
+	}
+	start := time.Now()
+	obj, err := b.next.Head(ctx, key)
+	b.record(start, err, true, probe)
+	return obj, err
+}
+
+func (b *BreakerStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return time.Time{}, err
+	}
+	start := time.Now()
+	updatedAt, err := b.next.UpdatedAt(ctx, key)
+	b.record(start, err, true, probe)
+	return updatedAt, err
+}
+
+// Put only counts errors: its duration follows the upstream body it streams.
+func (b *BreakerStore) Put(ctx context.Context, key string, obj Object) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = b.next.Put(ctx, key, obj)
+	b.record(start, err, false, probe)
+	return err
+}
+
+func (b *BreakerStore) Delete(ctx context.Context, key string) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = b.next.Delete(ctx, key)
+	b.record(start, err, true, probe)
+	return err
+}
+
+func (b *BreakerStore) DeleteMany(ctx context.Context, keys []string) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = DeleteMany(ctx, b.next, keys)
+	b.record(start, err, false, probe)
+	return err
+}
+
+func (b *BreakerStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return ListPage{}, err
+	}
+	start := time.Now()
+	page, err := List(ctx, b.next, opts)
+	b.record(start, err, false, probe)
+	return page, err
+}
+
+// allow reports whether a call may go through and whether it is the half-open
+// probe. Only the probe's result moves the breaker out of half-open, so calls
+// that started before the breaker opened cannot close or reopen it.
+func (b *BreakerStore) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		b.transition(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (b *BreakerStore) record(start time.Time, err error, checkLatency, probe bool) {
+	failed := err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupted) &&
+		!errors.Is(err, errors.ErrUnsupported)
+	if checkLatency && b.slow > 0 && time.Since(start) > b.slow {
+		failed = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which says nothing about the backend. A
+		// canceled probe leaves the breaker half-open for the next call.
+		return
+	}
+	if !failed {
+		b.consecutive = 0
+		if probe {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+	b.consecutive++
+	if probe || (b.failures > 0 && b.consecutive >= b.failures && b.state == BreakerClosed) {
+		b.openedAt = time.Now()
+		b.transition(BreakerOpen)
+	}
+}
+
+func (b *BreakerStore) transition(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	metrics.BreakerTransitions.WithLabelValues(b.backend, state).Inc()
+	b.setGauge(state)
+}
+
+func (b *BreakerStore) setGauge(state string) {
+	for _, s := range []string{BreakerClosed, BreakerHalfOpen, BreakerOpen} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		metrics.BreakerState.WithLabelValues(b.backend, s).Set(v)
+	}
+}
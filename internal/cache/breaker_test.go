@@ -0,0 +1,139 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestBreakerStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewBreakerStore(cache.NewMemoryStore(), "test", 5, time.Second, time.Second)
+	})
+}
+
+func TestBreakerStoreTrips(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingStore{Store: cache.NewMemoryStore(), fail: true}
+	b := cache.NewBreakerStore(backend, "test", 3, 0, 20*time.Millisecond)
+
+	for range 3 {
+		if _, err := b.Get(ctx, "page"); !errors.Is(err, errBackend) {
+			t.Fatalf("Get = %v, want the backend error", err)
+		}
+	}
+	if state := b.State(); state != cache.BreakerOpen {
+		t.Fatalf("state = %s, want open", state)
+	}
+	if _, err := b.Get(ctx, "page"); !errors.Is(err, cache.ErrCircuitOpen) {
+		t.Fatalf("Get while open = %v, want ErrCircuitOpen", err)
+	}
+
+	// A failed probe opens the breaker again.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Get(ctx, "page"); !errors.Is(err, errBackend) {
+		t.Fatalf("probe = %v, want the backend error", err)
+	}
+	if state := b.State(); state != cache.BreakerOpen {
+		t.Fatalf("state after a failed probe = %s, want open", state)
+	}
+
+	backend.fail = false
+	time.Sleep(30 * time.Millisecond)
+	if state := b.State(); state != cache.BreakerHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", state)
+	}
+	if _, err := b.Get(ctx, "page"); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("probe = %v, want ErrNotFound", err)
+	}
+	if state := b.State(); state != cache.BreakerClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", state)
+	}
+}
+
+// slowStore blocks Gets of "slow" until release is closed, fails Gets of
+// "bad" and reports Gets of "canceled" as canceled by the caller.
+type slowStore struct {
+	cache.Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Get(ctx context.Context, key string) (cache.Object, error) {
+	switch key {
+	case "slow":
+		close(s.started)
+		<-s.release
+	case "bad":
+		return cache.Object{}, errBackend
+	case "canceled":
+		return cache.Object{}, context.Canceled
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func TestBreakerStoreIgnoresStaleResults(t *testing.T) {
+	ctx := context.Background()
+	backend := &slowStore{
+		Store:   cache.NewMemoryStore(),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	b := cache.NewBreakerStore(backend, "test", 1, 0, 20*time.Millisecond)
+
+	stale := make(chan error, 1)
+	go func() {
+		_, err := b.Get(ctx, "slow")
+		stale <- err
+	}()
+	<-backend.started
+	if _, err := b.Get(ctx, "bad"); !errors.Is(err, errBackend) {
+		t.Fatalf("Get = %v, want the backend error", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if state := b.State(); state != cache.BreakerHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", state)
+	}
+
+	// A call from before the breaker opened finishing now is not the probe.
+	close(backend.release)
+	<-stale
+	if state := b.State(); state != cache.BreakerHalfOpen {
+		t.Fatalf("state after a stale success = %s, want half-open", state)
+	}
+	if _, err := b.Get(ctx, "bad"); !errors.Is(err, errBackend) {
+		t.Fatalf("probe = %v, want the backend error", err)
+	}
+	if state := b.State(); state != cache.BreakerOpen {
+		t.Fatalf("state after a failed probe = %s, want open", state)
+	}
+}
+
+func TestBreakerStoreCanceledProbe(t *testing.T) {
+	ctx := context.Background()
+	backend := &slowStore{Store: cache.NewMemoryStore()}
+	b := cache.NewBreakerStore(backend, "test", 1, 0, 20*time.Millisecond)
+
+	if _, err := b.Get(ctx, "bad"); !errors.Is(err, errBackend) {
+		t.Fatalf("Get = %v, want the backend error", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Get(ctx, "canceled"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("probe = %v, want context.Canceled", err)
+	}
+	if state := b.State(); state != cache.BreakerHalfOpen {
+		t.Fatalf("state after a canceled probe = %s, want half-open", state)
+	}
+
+	// The next call is the probe again.
+	if _, err := b.Get(ctx, "bad"); !errors.Is(err, errBackend) {
+		t.Fatalf("probe = %v, want the backend error", err)
+	}
+	if state := b.State(); state != cache.BreakerOpen {
+		t.Fatalf("state after a failed probe = %s, want open", state)
+	}
+}
@@ -0,0 +1,403 @@
+// Package cachetest checks that cache.Store implementations behave alike.
+package cachetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+)
+
+// Run tests the Store returned by newStore, which is called once per subtest.
+// Keys are placed under a random prefix so stores backed by shared buckets
+// can be tested as well.
+func Run(t *testing.T, newStore func(t *testing.T) cache.Store) {
+	prefix := "cachetest/" + randomHex(t) + "/"
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s cache.Store, prefix string)
+	}{
+		{"NotFound", testNotFound},
+		{"RoundTrip", testRoundTrip},
+		{"UpdatedAt", testUpdatedAt},
+		{"Overwrite", testOverwrite},
+		{"UnknownSize", testUnknownSize},
+		{"ShortBody", testShortBody},
+		{"EmptyBody", testEmptyBody},
+		{"MetaAfterBody", testMetaAfterBody},
+		{"LargeBody", testLargeBody},
+		{"Delete", testDelete},
+		{"List", testList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t), prefix+tt.name+"/")
+		})
+	}
+}
+
+var (
+	testTime   = time.Unix(1700000000, 0)
+	testHeader = http.Header{
+		"Content-Language": {"zh-Hans-CN"},
+		"Link":             {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+	}
+	testMeta = map[string]string{"cachetest": "1"}
+)
+
+func testNotFound(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	key := prefix + "missing"
+	if _, err := s.Get(ctx, key); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Head(ctx, key); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Head = %v, want ErrNotFound", err)
+	}
+	if _, err := s.UpdatedAt(ctx, key); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("UpdatedAt = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key = %v", err)
+	}
+}
+
+func testRoundTrip(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	key := prefix + "page/zh/皮卡丘"
+	body := randomBody(t, 200<<10)
+	put(t, s, key, cache.Object{
+		Body:        io.NopCloser(bytes.NewReader(body)),
+		Size:        int64(len(body)),
+		ContentType: "text/html; charset=UTF-8",
+		Encoding:    "gzip",
+		UpdatedAt:   testTime,
+		Header:      testHeader,
+		Meta:        testMeta,
+	})
+
+	obj, got := get(t, s, key)
+	if !bytes.Equal(got, body) {
+		t.Errorf("Get body differs: got %d bytes, want %d", len(got), len(body))
+	}
+	checkObject(t, "Get", obj, int64(len(body)))
+
+	head, err := s.Head(ctx, key)
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	if head.Body != nil {
+		t.Error("Head returned a body")
+	}
+	checkObject(t, "Head", head, int64(len(body)))
+	if head.ETag != obj.ETag {
+		t.Errorf("Head ETag = %q, Get ETag = %q", head.ETag, obj.ETag)
+	}
+}
+
+func checkObject(t *testing.T, op string, obj cache.Object, size int64) {
+	t.Helper()
+	if obj.Size != size {
+		t.Errorf("%s Size = %d, want %d", op, obj.Size, size)
+	}
+	if obj.ContentType != "text/html; charset=UTF-8" {
+		t.Errorf("%s ContentType = %q", op, obj.ContentType)
+	}
+	if obj.Encoding != "gzip" {
+		t.Errorf("%s Encoding = %q", op, obj.Encoding)
+	}
+	if !obj.UpdatedAt.Equal(testTime) {
+		t.Errorf("%s UpdatedAt = %v, want %v", op, obj.UpdatedAt, testTime)
+	}
+	if obj.ETag == "" {
+		t.Errorf("%s ETag is empty", op)
+	}
+	if !reflect.DeepEqual(obj.Header, testHeader) {
+		t.Errorf("%s Header = %v, want %v", op, obj.Header, testHeader)
+	}
+	for k, v := range testMeta {
+		if obj.Meta[k] != v {
+			t.Errorf("%s Meta[%q] = %q, want %q", op, k, obj.Meta[k], v)
+		}
+	}
+}
+
+func testUpdatedAt(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	key := prefix + "dated"
+	put(t, s, key, object("a", testTime))
+	got, err := s.UpdatedAt(ctx, key)
+	if err != nil {
+		t.Fatalf("UpdatedAt: %v", err)
+	}
+	if !got.Equal(testTime) {
+		t.Errorf("UpdatedAt = %v, want %v", got, testTime)
+	}
+
+	key = prefix + "undated"
+	put(t, s, key, object("a", time.Time{}))
+	got, err = s.UpdatedAt(ctx, key)
+	if err != nil {
+		t.Fatalf("UpdatedAt without a timestamp: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("UpdatedAt = %v, want zero", got)
+	}
+}
+
+func testOverwrite(t *testing.T, s cache.Store, prefix string) {
+	key := prefix + "page"
+	put(t, s, key, object("first", testTime))
+	first, _ := get(t, s, key)
+	later := testTime.Add(time.Hour)
+	put(t, s, key, object("second", later))
+
+	obj, body := get(t, s, key)
+	if string(body) != "second" {
+		t.Errorf("body = %q, want %q", body, "second")
+	}
+	if !obj.UpdatedAt.Equal(later) {
+		t.Errorf("UpdatedAt = %v, want %v", obj.UpdatedAt, later)
+	}
+	if obj.ETag == first.ETag {
+		t.Error("ETag did not change with the body")
+	}
+}
+
+func testUnknownSize(t *testing.T, s cache.Store, prefix string) {
+	key := prefix + "page"
+	body := randomBody(t, 100<<10)
+	obj := object("", testTime)
+	obj.Body = io.NopCloser(bytes.NewReader(body))
+	obj.Size = -1
+	put(t, s, key, obj)
+
+	obj, got := get(t, s, key)
+	if !bytes.Equal(got, body) {
+		t.Errorf("body differs: got %d bytes, want %d", len(got), len(body))
+	}
+	if obj.Size != int64(len(body)) {
+		t.Errorf("Size = %d, want %d", obj.Size, len(body))
+	}
+}
+
+func testShortBody(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	key := prefix + "page"
+	put(t, s, key, object("complete", testTime))
+
+	short := object("trunc", testTime.Add(time.Hour))
+	short.Size = 100
+	if err := s.Put(ctx, key, short); err == nil {
+		t.Fatal("Put of a truncated body succeeded")
+	}
+	obj, body := get(t, s, key)
+	if string(body) != "complete" || !obj.UpdatedAt.Equal(testTime) {
+		t.Errorf("previous object replaced by a truncated one: %q", body)
+	}
+
+	failing := object("", testTime)
+	failing.Body = io.NopCloser(io.MultiReader(strings.NewReader("partial"), errReader{}))
+	failing.Size = -1
+	if err := s.Put(ctx, key, failing); err == nil {
+		t.Fatal("Put of a failing body succeeded")
+	}
+	if _, body := get(t, s, key); string(body) != "complete" {
+		t.Errorf("previous object replaced by a failed one: %q", body)
+	}
+}
+
+func testEmptyBody(t *testing.T, s cache.Store, prefix string) {
+	key := prefix + "page"
+	put(t, s, key, object("", testTime))
+	obj, body := get(t, s, key)
+	if len(body) != 0 || obj.Size != 0 {
+		t.Errorf("got %d bytes, Size %d", len(body), obj.Size)
+	}
+}
+
+func testMetaAfterBody(t *testing.T, s cache.Store, prefix string) {
+	key := prefix + "page"
+	obj := object("<p>皮卡丘</p>", testTime)
+	body := &eofReader{r: obj.Body}
+	obj.Body = io.NopCloser(body)
+	obj.MetaAfterBody = func() map[string]string {
+		if !body.eof {
+			return map[string]string{"late": "early"}
+		}
+		return map[string]string{"late": "1"}
+	}
+	put(t, s, key, obj)
+	got, _ := get(t, s, key)
+	if got.Meta["late"] != "1" {
+		t.Errorf("Meta = %v, want the entries of MetaAfterBody once the body was read", got.Meta)
+	}
+}
+
+// largeBodySize exceeds the 5 MiB part size above which S3Store switches to a
+// multipart upload.
+const largeBodySize = 6 << 20
+
+func testLargeBody(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	key := prefix + "page"
+	body := randomBody(t, largeBodySize)
+	eof := &eofReader{r: bytes.NewReader(body)}
+	put(t, s, key, cache.Object{
+		Body:        io.NopCloser(eof),
+		Size:        -1,
+		ContentType: "text/html; charset=UTF-8",
+		Encoding:    "gzip",
+		UpdatedAt:   testTime,
+		Header:      testHeader,
+		Meta:        testMeta,
+		MetaAfterBody: func() map[string]string {
+			return map[string]string{"late": strconv.FormatBool(eof.eof)}
+		},
+	})
+
+	obj, got := get(t, s, key)
+	if !bytes.Equal(got, body) {
+		t.Errorf("Get body differs: got %d bytes, want %d", len(got), len(body))
+	}
+	checkObject(t, "Get", obj, int64(len(body)))
+	if obj.Meta["late"] != "true" {
+		t.Errorf("Meta = %v, want the entries of MetaAfterBody once the body was read", obj.Meta)
+	}
+	head, err := s.Head(ctx, key)
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	checkObject(t, "Head", head, int64(len(body)))
+	if head.ETag != obj.ETag {
+		t.Errorf("Head ETag = %q, Get ETag = %q", head.ETag, obj.ETag)
+	}
+}
+
+// eofReader records whether r was read to EOF.
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
+
+func testDelete(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	keys := []string{prefix + "a", prefix + "b", prefix + "c"}
+	for _, key := range keys {
+		put(t, s, key, object(key, testTime))
+	}
+	if err := s.Delete(ctx, keys[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := cache.DeleteMany(ctx, s, keys[1:]); err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := s.Get(ctx, key); !errors.Is(err, cache.ErrNotFound) {
+			t.Errorf("Get(%q) after delete = %v, want ErrNotFound", key, err)
+		}
+	}
+}
+
+func testList(t *testing.T, s cache.Store, prefix string) {
+	ctx := context.Background()
+	var want []string
+	for _, name := range []string{"a/1", "a/2", "a/3", "a/4", "a/5"} {
+		want = append(want, prefix+name)
+		put(t, s, prefix+name, object(name, testTime))
+	}
+	put(t, s, prefix+"b/1", object("other", testTime))
+
+	var got []string
+	opts := cache.ListOptions{Prefix: prefix + "a/", Limit: 2}
+	for range 10 {
+		page, err := cache.List(ctx, s, opts)
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip("store does not support listing")
+		}
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, e := range page.Entries {
+			got = append(got, e.Key)
+			// S3 listings only carry the upload time.
+			if e.UpdatedAt.IsZero() {
+				t.Errorf("entry %q has no UpdatedAt", e.Key)
+			}
+		}
+		if page.Cursor == "" {
+			break
+		}
+		opts.Cursor = page.Cursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+}
+
+func object(body string, updatedAt time.Time) cache.Object {
+	return cache.Object{
+		Body:        io.NopCloser(strings.NewReader(body)),
+		Size:        int64(len(body)),
+		ContentType: "text/html; charset=UTF-8",
+		UpdatedAt:   updatedAt,
+	}
+}
+
+func put(t *testing.T, s cache.Store, key string, obj cache.Object) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, obj); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+func get(t *testing.T, s cache.Store, key string) (cache.Object, []byte) {
+	t.Helper()
+	obj, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return obj, body
+}
+
+func randomBody(t *testing.T, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func randomHex(t *testing.T) string {
+	return hex.EncodeToString(randomBody(t, 8))
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("upstream went away")
+}
@@ -0,0 +1,333 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskStore keeps objects as files under a local directory. Each file holds
+// the body followed by a JSON metadata trailer and the trailer length, so the
+// metadata can be written after the body.
+type DiskStore struct {
+	root string
+
+	mu       sync.Mutex
+	nextID   uint64
+	listings map[string]*diskListing
+}
+
+// diskListing is the sorted result of one directory walk, kept so that the
+// following pages of a paged listing do not walk the directory again.
+type diskListing struct {
+	prefix    string
+	entries   []Entry
+	expiresAt time.Time
+}
+
+const (
+	diskListingTTL = 5 * time.Minute
+	maxDiskListing = 16
+)
+
+type diskMeta struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"content_type,omitempty"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+const diskTrailerLenSize = 8
+
+func NewDiskStore(root string) (*DiskStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{root: root, listings: make(map[string]*diskListing)}, nil
+}
+
+func (s *DiskStore) Get(ctx context.Context, key string) (Object, error) {
+	f, err := s.open(key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	meta, bodySize, err := readDiskMeta(f, key)
+	if err != nil {
+		f.Close()
+		return Object{}, err
+	}
+
+	obj := Object{
+		Body:        readCloser{Reader: io.NewSectionReader(f, 0, bodySize), Closer: f},
+		Size:        bodySize,
+		ContentType: meta.ContentType,
+		Encoding:    meta.Encoding,
+	}
+	decodeMetadata(meta.Metadata, &obj)
+	return verifyBody(obj), nil
+}
+
+func (s *DiskStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	f, err := s.open(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	meta, _, err := readDiskMeta(f, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseUpdatedAt(meta.Metadata), nil
+}
+
+func (s *DiskStore) Head(ctx context.Context, key string) (Object, error) {
+	f, err := s.open(key)
+	if err != nil {
+		return Object{}, err
+	}
+	defer f.Close()
+
+	meta, bodySize, err := readDiskMeta(f, key)
+	if err != nil {
+		return Object{}, err
+	}
+	obj := Object{
+		Size:        bodySize,
+		ContentType: meta.ContentType,
+		Encoding:    meta.Encoding,
+	}
+	decodeMetadata(meta.Metadata, &obj)
+	return obj, nil
+}
+
+func (s *DiskStore) Put(ctx context.Context, key string, obj Object) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	body := newHashingReader(&sizedReader{r: obj.Body, size: obj.Size})
+	if _, err := io.Copy(tmp, body); err != nil {
+		return err
+	}
+	obj.ETag = body.ETag()
+	obj.Checksum = body.Checksum()
+	trailer, err := json.Marshal(diskMeta{
+		Key:         key,
+		ContentType: obj.ContentType,
+		Encoding:    obj.Encoding,
+		Metadata:    encodeMetadata(obj),
+	})
+	if err != nil {
+		return err
+	}
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(len(trailer)))
+	if _, err := tmp.Write(trailer); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List walks the whole directory, since file names are hashes of the keys.
+// The walk is kept for a few minutes and the following pages are served from
+// it, so paging through N objects opens each file once rather than once per
+// page. Cursor is the listing ID and the last key of the previous page.
+func (s *DiskStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	id, after, ok := strings.Cut(opts.Cursor, ":")
+	if !ok {
+		id, after = "", opts.Cursor
+	}
+	entries, ok := s.listing(id, opts.Prefix)
+	if !ok {
+		var err error
+		if entries, err = s.walk(ctx, opts.Prefix); err != nil {
+			return ListPage{}, err
+		}
+		id = ""
+	}
+
+	entries = entries[sort.Search(len(entries), func(i int) bool { return entries[i].Key > after }):]
+	if opts.Limit <= 0 || len(entries) <= opts.Limit {
+		s.dropListing(id)
+		return ListPage{Entries: entries}, nil
+	}
+	page := ListPage{Entries: entries[:opts.Limit:opts.Limit]}
+	if id == "" {
+		id = s.saveListing(opts.Prefix, entries)
+	}
+	page.Cursor = id + ":" + page.Entries[opts.Limit-1].Key
+	return page, nil
+}
+
+// walk reads the metadata of every object under the prefix and returns the
+// entries sorted by key.
+func (s *DiskStore) walk(ctx context.Context, prefix string) ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "tmp" {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+		meta, bodySize, err := readDiskMeta(f, "")
+		if err != nil {
+			// Skip files that are not cache objects rather than failing the
+			// whole listing.
+			return nil
+		}
+		if !strings.HasPrefix(meta.Key, prefix) {
+			return nil
+		}
+		entries = append(entries, Entry{
+			Key:       meta.Key,
+			Size:      bodySize,
+			UpdatedAt: parseUpdatedAt(meta.Metadata),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+func (s *DiskStore) listing(id, prefix string) ([]Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.listings[id]
+	if !ok || l.prefix != prefix || !time.Now().Before(l.expiresAt) {
+		return nil, false
+	}
+	return l.entries, true
+}
+
+// saveListing keeps entries for the following pages and returns their ID.
+// Expired listings are dropped, and the oldest one when there are too many.
+func (s *DiskStore) saveListing(prefix string, entries []Entry) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var oldest string
+	for id, l := range s.listings {
+		if !now.Before(l.expiresAt) {
+			delete(s.listings, id)
+		} else if oldest == "" || l.expiresAt.Before(s.listings[oldest].expiresAt) {
+			oldest = id
+		}
+	}
+	if len(s.listings) >= maxDiskListing {
+		delete(s.listings, oldest)
+	}
+	s.nextID++
+	id := strconv.FormatUint(s.nextID, 36)
+	s.listings[id] = &diskListing{prefix: prefix, entries: entries, expiresAt: now.Add(diskListingTTL)}
+	return id
+}
+
+func (s *DiskStore) dropListing(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listings, id)
+}
+
+// path maps a key to a file name. Keys are hashed because titles may contain
+// characters or lengths the filesystem does not accept.
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.root, name[:2], name)
+}
+
+func (s *DiskStore) open(key string) (*os.File, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// readDiskMeta reads the trailer of f and checks that it belongs to key, unless
+// key is empty.
+func readDiskMeta(f *os.File, key string) (diskMeta, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return diskMeta{}, 0, err
+	}
+	size := info.Size()
+	if size < diskTrailerLenSize {
+		return diskMeta{}, 0, fmt.Errorf("disk cache file %s is truncated", f.Name())
+	}
+	var lenBuf [diskTrailerLenSize]byte
+	if _, err := f.ReadAt(lenBuf[:], size-diskTrailerLenSize); err != nil {
+		return diskMeta{}, 0, err
+	}
+	trailerLen := int64(binary.BigEndian.Uint64(lenBuf[:]))
+	bodySize := size - diskTrailerLenSize - trailerLen
+	if trailerLen < 0 || bodySize < 0 {
+		return diskMeta{}, 0, fmt.Errorf("disk cache file %s has an invalid trailer", f.Name())
+	}
+	trailer := make([]byte, trailerLen)
+	if _, err := f.ReadAt(trailer, bodySize); err != nil {
+		return diskMeta{}, 0, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(trailer, &meta); err != nil {
+		return diskMeta{}, 0, err
+	}
+	if key != "" && meta.Key != key {
+		return diskMeta{}, 0, ErrNotFound
+	}
+	return meta, bodySize, nil
+}
@@ -0,0 +1,118 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestDiskStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		s, err := cache.NewDiskStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestDiskStoreCorrupted(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := cache.NewDiskStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "<p>Pikachu</p>"
+	err = s.Put(ctx, "page", cache.Object{
+		Body:      io.NopCloser(strings.NewReader(body)),
+		Size:      int64(len(body)),
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(root, "[0-9a-f][0-9a-f]", "*"))
+	if len(files) != 1 {
+		t.Fatalf("found %d object files, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(files[0], data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Get(ctx, "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+	if _, err := io.ReadAll(obj.Body); !errors.Is(err, cache.ErrCorrupted) {
+		t.Fatalf("reading a corrupted body = %v, want ErrCorrupted", err)
+	}
+}
+
+func TestDiskStoreListReusesWalk(t *testing.T) {
+	ctx := context.Background()
+	s, err := cache.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string) {
+		t.Helper()
+		err := s.Put(ctx, key, cache.Object{
+			Body:      io.NopCloser(strings.NewReader(key)),
+			Size:      int64(len(key)),
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		put(key)
+	}
+
+	page, err := s.List(ctx, cache.ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.Cursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	// Pages after the first come from the walk the first page made, so a
+	// key written in between is not listed.
+	put("bb")
+	var keys []string
+	for page.Cursor != "" {
+		if page, err = s.List(ctx, cache.ListOptions{Cursor: page.Cursor, Limit: 2}); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page.Entries {
+			keys = append(keys, e.Key)
+		}
+	}
+	if strings.Join(keys, ",") != "c,d" {
+		t.Errorf("later pages = %v, want [c d]", keys)
+	}
+
+	page, err = s.List(ctx, cache.ListOptions{Cursor: "b", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 3 || page.Entries[0].Key != "bb" {
+		t.Errorf("listing after key b = %+v, want bb, c, d", page.Entries)
+	}
+}
@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"time"
+)
+
+const (
+	encAlgMetaKey   = "enc_alg"
+	encKeyIDMetaKey = "enc_key_id"
+	encDEKMetaKey   = "enc_dek"
+
+	// encAlg is AES-256-GCM over 64 KiB chunks, each sealed with a nonce made
+	// of its index and a flag marking the final chunk, under a random data key.
+	encAlg       = "aes256gcm-64k"
+	encChunkSize = 64 << 10
+	encTagSize   = 16
+)
+
+// EncryptedStore encrypts object bodies before handing them to the next Store.
+// Every object gets its own data key, which is stored in the object metadata
+// wrapped by a key encryption key together with that key's ID. Objects written
+// without encryption are passed through as-is, and objects wrapped by a key
+// that is no longer configured are reported as not found so they get refilled.
+//
+// Only the body is encrypted; metadata such as captured headers is not. Sizes
+// in listings are those of the encrypted bodies.
+type EncryptedStore struct {
+	next    Store
+	current string
+	keks    map[string]cipher.AEAD
+}
+
+// NewEncryptedStore wraps next. keys are "id:base64" pairs of 32-byte keys;
+// the first one encrypts new objects and all of them are used to decrypt.
+func NewEncryptedStore(next Store, keys []string) (*EncryptedStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	s := &EncryptedStore{next: next, keks: map[string]cipher.AEAD{}}
+	for _, entry := range keys {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, errors.New(`encryption keys must be "id:base64"`)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes", id)
+		}
+		if _, dup := s.keks[id]; dup {
+			return nil, fmt.Errorf("duplicate encryption key %q", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		s.keks[id] = aead
+		if s.current == "" {
+			s.current = id
+		}
+	}
+	return s, nil
+}
+
+func (s *EncryptedStore) Get(ctx context.Context, key string) (Object, error) {
+	obj, err := s.next.Get(ctx, key)
+	if err != nil || obj.Meta[encAlgMetaKey] == "" {
+		return obj, err
+	}
+	aead, err := s.unwrap(obj.Meta)
+	if err != nil {
+		obj.Body.Close()
+		return Object{}, err
+	}
+	obj.Body = readCloser{Reader: newOpenReader(obj.Body, aead), Closer: obj.Body}
+	obj.Size = plainSize(obj.Size)
+	obj.Meta = stripEncMeta(obj.Meta)
+	return obj, nil
+}
+
+func (s *EncryptedStore) Head(ctx context.Context, key string) (Object, error) {
+	obj, err := s.next.Head(ctx, key)
+	if err != nil || obj.Meta[encAlgMetaKey] == "" {
+		return obj, err
+	}
+	if _, err := s.unwrap(obj.Meta); err != nil {
+		return Object{}, err
+	}
+	obj.Size = plainSize(obj.Size)
+	obj.Meta = stripEncMeta(obj.Meta)
+	return obj, nil
+}
+
+func (s *EncryptedStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	return s.next.UpdatedAt(ctx, key)
+}
+
+func (s *EncryptedStore) Put(ctx context.Context, key string, obj Object) error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return err
+	}
+	wrapped, err := s.wrap(dek)
+	if err != nil {
+		return err
+	}
+
+	meta := maps.Clone(obj.Meta)
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta[encAlgMetaKey] = encAlg
+	meta[encKeyIDMetaKey] = s.current
+	meta[encDEKMetaKey] = wrapped
+	obj.Meta = meta
+	obj.Body = io.NopCloser(newSealReader(obj.Body, aead))
+	obj.Size = sealedSize(obj.Size)
+	return s.next.Put(ctx, key, obj)
+}
+
+func (s *EncryptedStore) Delete(ctx context.Context, key string) error {
+	return s.next.Delete(ctx, key)
+}
+
+func (s *EncryptedStore) DeleteMany(ctx context.Context, keys []string) error {
+	return DeleteMany(ctx, s.next, keys)
+}
+
+func (s *EncryptedStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return List(ctx, s.next, opts)
+}
+
+// wrap seals dek with the current key; the key ID is authenticated as well.
+func (s *EncryptedStore) wrap(dek []byte) (string, error) {
+	kek := s.keks[s.current]
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := kek.Seal(nonce, nonce, dek, []byte(s.current))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *EncryptedStore) unwrap(meta map[string]string) (cipher.AEAD, error) {
+	if alg := meta[encAlgMetaKey]; alg != encAlg {
+		return nil, fmt.Errorf("unsupported encryption %q", alg)
+	}
+	id := meta[encKeyIDMetaKey]
+	kek, ok := s.keks[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown encryption key %q", ErrNotFound, id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(meta[encDEKMetaKey])
+	if err != nil || len(sealed) < kek.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed data key", ErrCorrupted)
+	}
+	dek, err := kek.Open(nil, sealed[:kek.NonceSize()], sealed[kek.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: unwrap data key: %v", ErrCorrupted, err)
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key: %v", ErrCorrupted, err)
+	}
+	return aead, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func stripEncMeta(meta map[string]string) map[string]string {
+	meta = maps.Clone(meta)
+	delete(meta, encAlgMetaKey)
+	delete(meta, encKeyIDMetaKey)
+	delete(meta, encDEKMetaKey)
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// An empty body is still sealed as one empty final chunk.
+func sealedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := max(1, (size+encChunkSize-1)/encChunkSize)
+	return size + chunks*encTagSize
+}
+
+func plainSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := max(1, (size+encChunkSize+encTagSize-1)/(encChunkSize+encTagSize))
+	return size - chunks*encTagSize
+}
+
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// readChunk fills buf unless r ends or fails first. Unlike io.ReadFull it
+// only treats io.EOF as the end of the stream.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// chunkReader emits the chunks produced by next until the final one.
+type chunkReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	in    []byte
+	buf   []byte
+	out   []byte
+	index uint64
+	done  bool
+	next  func(r *chunkReader, n int, last bool) error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := readChunk(c.src, c.in)
+		last := false
+		switch {
+		case err == io.EOF:
+			last = true
+		case err != nil:
+			return 0, err
+		default:
+			if _, err := c.src.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		if err := c.next(c, n, last); err != nil {
+			return 0, err
+		}
+		c.index++
+		c.done = last
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func newSealReader(r io.Reader, aead cipher.AEAD) io.Reader {
+	return &chunkReader{
+		src:  bufio.NewReader(r),
+		aead: aead,
+		in:   make([]byte, encChunkSize),
+		next: func(c *chunkReader, n int, last bool) error {
+			c.buf = c.aead.Seal(c.buf[:0], chunkNonce(c.index, last), c.in[:n], nil)
+			c.out = c.buf
+			return nil
+		},
+	}
+}
+
+func newOpenReader(r io.Reader, aead cipher.AEAD) io.Reader {
+	return &chunkReader{
+		src:  bufio.NewReader(r),
+		aead: aead,
+		in:   make([]byte, encChunkSize+encTagSize),
+		next: func(c *chunkReader, n int, last bool) error {
+			// A chunk that fails to open was altered, reordered or cut short,
+			// which the final chunk flag in the nonce catches for truncation.
+			plain, err := c.aead.Open(c.buf[:0], chunkNonce(c.index, last), c.in[:n], nil)
+			if err != nil {
+				return fmt.Errorf("%w: decrypt chunk %d: %v", ErrCorrupted, c.index, err)
+			}
+			c.buf = plain
+			c.out = plain
+			return nil
+		},
+	}
+}
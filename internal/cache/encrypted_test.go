@@ -0,0 +1,201 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryptedStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		s, err := cache.NewEncryptedStore(cache.NewMemoryStore(), []string{testKey("k1", 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	ctx := context.Background()
+	backend := cache.NewMemoryStore()
+	old, err := cache.NewEncryptedStore(backend, []string{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := cache.NewEncryptedStore(backend, []string{testKey("k2", 2), testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := cache.NewEncryptedStore(backend, []string{testKey("k2", 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("<p>皮卡丘</p>", 10000)
+	put := func(s cache.Store, key string) {
+		err := s.Put(ctx, key, cache.Object{
+			Body:      io.NopCloser(strings.NewReader(body)),
+			Size:      int64(len(body)),
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(old, "old")
+	put(rotated, "new")
+	if err := backend.Put(ctx, "plain", cache.Object{Body: io.NopCloser(strings.NewReader(body)), Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if raw := readBody(t, backend, "new"); strings.Contains(raw, "皮卡丘") {
+		t.Error("stored body is not encrypted")
+	}
+	for _, key := range []string{"old", "new", "plain"} {
+		if got := readBody(t, rotated, key); got != body {
+			t.Errorf("%s: body differs after decryption", key)
+		}
+	}
+	if _, err := retired.Get(ctx, "old"); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Get with a removed key = %v, want ErrNotFound", err)
+	}
+	if _, err := old.Get(ctx, "new"); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Get with an unknown key = %v, want ErrNotFound", err)
+	}
+}
+
+func TestNewEncryptedStoreInvalidKeys(t *testing.T) {
+	for _, keys := range [][]string{
+		nil,
+		{"nokey"},
+		{"k1:not-base64!"},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{testKey("k1", 1), testKey("k1", 2)},
+	} {
+		if _, err := cache.NewEncryptedStore(cache.NewMemoryStore(), keys); err == nil {
+			t.Errorf("NewEncryptedStore(%q) succeeded", keys)
+		}
+	}
+}
+
+func TestEncryptedStoreCorruptedChunk(t *testing.T) {
+	ctx := context.Background()
+	backend := cache.NewMemoryStore()
+	s, err := cache.NewEncryptedStore(backend, []string{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("<p>皮卡丘</p>", 20000)
+	err = s.Put(ctx, "page", cache.Object{
+		Body:      io.NopCloser(strings.NewReader(body)),
+		Size:      int64(len(body)),
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := backend.Get(ctx, "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(raw.Body)
+	raw.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"middle chunk": func() []byte {
+			data := bytes.Clone(sealed)
+			data[70000] ^= 0xff
+			return data
+		}(),
+		"truncated": sealed[:2*(64<<10+16)],
+	} {
+		// Rewriting through the backend records a checksum of the damaged
+		// body, so only decryption can notice.
+		obj := raw
+		obj.Body = io.NopCloser(bytes.NewReader(data))
+		obj.Size = int64(len(data))
+		if err := backend.Put(ctx, "page", obj); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(got.Body)
+		got.Body.Close()
+		if !errors.Is(err, cache.ErrCorrupted) {
+			t.Errorf("%s: reading = %v, want ErrCorrupted", name, err)
+		}
+	}
+}
+
+func TestEncryptedStoreTamperedDataKey(t *testing.T) {
+	ctx := context.Background()
+	backend := cache.NewMemoryStore()
+	s, err := cache.NewEncryptedStore(backend, []string{testKey("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put(ctx, "page", cache.Object{
+		Body:      io.NopCloser(strings.NewReader("<p>皮卡丘</p>")),
+		Size:      -1,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := backend.Get(ctx, "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(raw.Body)
+	raw.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek, err := base64.StdEncoding.DecodeString(raw.Meta["enc_dek"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tampered := range map[string]string{
+		"flipped": func() string {
+			dek := bytes.Clone(dek)
+			dek[len(dek)-1] ^= 0xff
+			return base64.StdEncoding.EncodeToString(dek)
+		}(),
+		"truncated": base64.StdEncoding.EncodeToString(dek[:4]),
+		"malformed": "not base64!",
+	} {
+		obj := raw
+		obj.Body = io.NopCloser(bytes.NewReader(sealed))
+		obj.Meta = maps.Clone(raw.Meta)
+		obj.Meta["enc_dek"] = tampered
+		if err := backend.Put(ctx, "page", obj); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, "page"); !errors.Is(err, cache.ErrCorrupted) {
+			t.Errorf("%s: Get = %v, want ErrCorrupted", name, err)
+		}
+		if _, err := s.Head(ctx, "page"); !errors.Is(err, cache.ErrCorrupted) {
+			t.Errorf("%s: Head = %v, want ErrCorrupted", name, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+)
+
+// neverCaptured lists headers that are per-user, per-connection, or set by
+// Inazuma itself. They are dropped even if an allowlist names them.
+var neverCaptured = map[string]struct{}{
+	"Set-Cookie":          {},
+	"Cookie":              {},
+	"Authorization":       {},
+	"Www-Authenticate":    {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Transfer-Encoding":   {},
+	"Content-Length":      {},
+	"Content-Type":        {},
+	"Content-Encoding":    {},
+	"Etag":                {},
+	"Last-Modified":       {},
+	"Vary":                {},
+	"Date":                {},
+	"Age":                 {},
+	"X-Inazuma-Cache":     {},
+}
+
+// maxHeaderMetaBytes keeps captured headers well inside the 2 KB S3 limit
+// for user metadata.
+const maxHeaderMetaBytes = 1536
+
+// CaptureHeaders returns the headers from src named in allow that are safe to
+// replay to every client.
+func CaptureHeaders(src http.Header, allow []string) http.Header {
+	out := http.Header{}
+	for _, name := range allow {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if _, ok := neverCaptured[name]; ok {
+			continue
+		}
+		if vv := src.Values(name); len(vv) > 0 {
+			out[name] = append([]string(nil), vv...)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// encodeHeaders serializes h into an ASCII-safe metadata value. Headers that
+// would push the value past maxHeaderMetaBytes are left out.
+func encodeHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	encoded := ""
+	for _, name := range names {
+		next := url.Values{name: h[name]}.Encode()
+		if encoded != "" {
+			next = encoded + "&" + next
+		}
+		if len(next) > maxHeaderMetaBytes {
+			continue
+		}
+		encoded = next
+	}
+	return encoded
+}
+
+func decodeHeaders(val string) http.Header {
+	values, err := url.ParseQuery(val)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	h := http.Header{}
+	for name, vv := range values {
+		h[textproto.CanonicalMIMEHeaderKey(name)] = vv
+	}
+	return h
+}
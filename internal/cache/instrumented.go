@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/52poke/inazuma/internal/metrics"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstrumentedStore records latency, errors and bytes transferred for every
+// operation on the wrapped Store.
+type InstrumentedStore struct {
+	next    Store
+	backend string
+	read    prometheus.Counter
+	written prometheus.Counter
+}
+
+// NewInstrumentedStore wraps next, labelling its metrics with backend.
+func NewInstrumentedStore(next Store, backend string) *InstrumentedStore {
+	return &InstrumentedStore{
+		next:    next,
+		backend: backend,
+		read:    metrics.StoreReadBytes.WithLabelValues(backend),
+		written: metrics.StoreWrittenBytes.WithLabelValues(backend),
+	}
+}
+
+func (s *InstrumentedStore) Get(ctx context.Context, key string) (Object, error) {
+	start := time.Now()
+	obj, err := s.next.Get(ctx, key)
+	s.observe("get", start, err)
+	if err != nil {
+		return Object{}, err
+	}
+	obj.Body = readCloser{Reader: &countingReader{r: obj.Body, counter: s.read}, Closer: obj.Body}
+	return obj, nil
+}
+
+func (s *InstrumentedStore) Head(ctx context.Context, key string) (Object, error) {
+	start := time.Now()
+	obj, err := s.next.Head(ctx, key)
+	s.observe("head", start, err)
+	return obj, err
+}
+
+func (s *InstrumentedStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	start := time.Now()
+	updatedAt, err := s.next.UpdatedAt(ctx, key)
+	s.observe("updated_at", start, err)
+	return updatedAt, err
+}
+
+func (s *InstrumentedStore) Put(ctx context.Context, key string, obj Object) error {
+	start := time.Now()
+	obj.Body = readCloser{Reader: &countingReader{r: obj.Body, counter: s.written}, Closer: obj.Body}
+	err := s.next.Put(ctx, key, obj)
+	s.observe("put", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.next.Delete(ctx, key)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) DeleteMany(ctx context.Context, keys []string) error {
+	start := time.Now()
+	err := DeleteMany(ctx, s.next, keys)
+	s.observe("delete_many", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	start := time.Now()
+	page, err := List(ctx, s.next, opts)
+	s.observe("list", start, err)
+	return page, err
+}
+
+func (s *InstrumentedStore) observe(op string, start time.Time, err error) {
+	metrics.StoreDuration.WithLabelValues(s.backend, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.StoreErrors.WithLabelValues(s.backend, op, errorType(err)).Inc()
+	}
+}
+
+// errorType classifies err into a small set of label values. Errors returned
+// by the object storage API are labelled with their error code.
+func errorType(err error) string {
+	var apiErr smithy.APIError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, errors.ErrUnsupported):
+		return "unsupported"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &apiErr):
+		return apiErr.ErrorCode()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
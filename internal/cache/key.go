@@ -1,7 +1,158 @@
 package cache
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
 
+// KeySchema is the version prefix of the current key layout. Bump it whenever
+// key derivation or title normalization changes so new keys never collide
+// with objects written under the old rules.
+const KeySchema = "v1"
+
+const (
+	pagePrefix = KeySchema + "/page/"
+	// maxTitleKeyBytes bounds the escaped title so keys stay well below the
+	// 1024-byte S3 limit. Longer titles keep a prefix of this length followed
+	// by hashMarker and a hash of the full title.
+	maxTitleKeyBytes = 512
+	hashMarker       = "~"
+
+	legacyPagePrefix = "page/"
+)
+
+// PageKey returns the storage key of a page variant. Titles are escaped so
+// every key is safe for S3 and escaping preserves prefixes, so keys of titles
+// sharing a prefix share a key prefix as well.
 func PageKey(variant, title string) string {
-	return fmt.Sprintf("page/%s/%s", variant, title)
+	escaped := escapeTitle(title)
+	if len(escaped) > maxTitleKeyBytes {
+		sum := sha256.Sum256([]byte(title))
+		escaped = truncateEscaped(escaped, maxTitleKeyBytes) + hashMarker + hex.EncodeToString(sum[:16])
+	}
+	return fmt.Sprintf("%s%s/%s", pagePrefix, variant, escaped)
+}
+
+// PageKeyPrefix returns the key prefix shared by the keys of all titles of
+// variant starting with titlePrefix. Prefixes longer than the part of a title
+// kept in hashed keys are shortened, so they may match more titles.
+func PageKeyPrefix(variant, titlePrefix string) string {
+	escaped := truncateEscaped(escapeTitle(titlePrefix), maxTitleKeyBytes)
+	return fmt.Sprintf("%s%s/%s", pagePrefix, variant, escaped)
+}
+
+// ParsePageKey reverses PageKey. It reports false for keys of another layout
+// and for hashed keys, whose title cannot be recovered.
+func ParsePageKey(key string) (variant, title string, ok bool) {
+	rest, found := strings.CutPrefix(key, pagePrefix)
+	if !found {
+		return "", "", false
+	}
+	variant, escaped, found := strings.Cut(rest, "/")
+	if !found || strings.Contains(escaped, hashMarker) {
+		return "", "", false
+	}
+	title, err := unescapeTitle(escaped)
+	if err != nil {
+		return "", "", false
+	}
+	return variant, title, true
+}
+
+// LegacyPageKey returns the key used before KeySchema was introduced.
+func LegacyPageKey(variant, title string) string {
+	return fmt.Sprintf("%s%s/%s", legacyPagePrefix, variant, title)
+}
+
+// ParseLegacyPageKey reverses LegacyPageKey.
+func ParseLegacyPageKey(key string) (variant, title string, ok bool) {
+	rest, found := strings.CutPrefix(key, legacyPagePrefix)
+	if !found {
+		return "", "", false
+	}
+	variant, title, found = strings.Cut(rest, "/")
+	if !found || variant == "" || title == "" {
+		return "", "", false
+	}
+	return variant, title, true
+}
+
+const upperhex = "0123456789ABCDEF"
+
+// escapeTitle percent-encodes every byte outside the characters S3 documents
+// as safe for object keys.
+func escapeTitle(title string) string {
+	var b strings.Builder
+	for i := 0; i < len(title); i++ {
+		c := title[i]
+		if isSafeKeyByte(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperhex[c>>4])
+		b.WriteByte(upperhex[c&15])
+	}
+	return b.String()
+}
+
+func unescapeTitle(escaped string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", fmt.Errorf("truncated escape in %q", escaped)
+		}
+		hi, lo := unhex(escaped[i+1]), unhex(escaped[i+2])
+		if hi < 0 || lo < 0 {
+			return "", fmt.Errorf("invalid escape in %q", escaped)
+		}
+		b.WriteByte(byte(hi<<4 | lo))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// truncateEscaped cuts escaped to at most n bytes without splitting an escape.
+func truncateEscaped(escaped string, n int) string {
+	if len(escaped) <= n {
+		return escaped
+	}
+	cut := n
+	for i := n - 1; i >= 0 && i >= n-2; i-- {
+		if escaped[i] == '%' {
+			cut = i
+		}
+	}
+	return escaped[:cut]
+}
+
+func isSafeKeyByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	switch c {
+	case '/', '!', '-', '_', '.', '*', '\'', '(', ')':
+		return true
+	}
+	return false
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c-'a') + 10
+	case 'A' <= c && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
 }
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps objects in a map. It persists the same metadata as the
+// other stores and is meant for tests and throwaway instances; nothing bounds
+// its size.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	body        []byte
+	contentType string
+	encoding    string
+	meta        map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Object, error) {
+	m, ok := s.load(key)
+	if !ok {
+		return Object{}, ErrNotFound
+	}
+	obj := m.object()
+	obj.Body = io.NopCloser(bytes.NewReader(m.body))
+	return verifyBody(obj), nil
+}
+
+func (s *MemoryStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	m, ok := s.load(key)
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return parseUpdatedAt(m.meta), nil
+}
+
+func (s *MemoryStore) Head(ctx context.Context, key string) (Object, error) {
+	m, ok := s.load(key)
+	if !ok {
+		return Object{}, ErrNotFound
+	}
+	return m.object(), nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, obj Object) error {
+	body := newHashingReader(&sizedReader{r: obj.Body, size: obj.Size})
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	obj.ETag = body.ETag()
+	obj.Checksum = body.Checksum()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{
+		body:        data,
+		contentType: obj.ContentType,
+		encoding:    obj.Encoding,
+		meta:        encodeMetadata(obj),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	s.mu.RLock()
+	var entries []Entry
+	for key, m := range s.objects {
+		if !strings.HasPrefix(key, opts.Prefix) || key <= opts.Cursor {
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:       key,
+			Size:      int64(len(m.body)),
+			UpdatedAt: parseUpdatedAt(m.meta),
+		})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	page := ListPage{Entries: entries}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		page.Entries = entries[:opts.Limit]
+		page.Cursor = page.Entries[opts.Limit-1].Key
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) load(key string) (memoryObject, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.objects[key]
+	return m, ok
+}
+
+func (m memoryObject) object() Object {
+	obj := Object{
+		Size:        int64(len(m.body)),
+		ContentType: m.contentType,
+		Encoding:    m.encoding,
+	}
+	decodeMetadata(m.meta, &obj)
+	return obj
+}
@@ -0,0 +1,14 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewMemoryStore()
+	})
+}
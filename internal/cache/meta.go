@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	updatedAtMetaKey = "updated_at"
+	etagMetaKey      = "etag"
+	checksumMetaKey  = "sha256"
+	headersMetaKey   = "headers"
+)
+
+// encodeMetadata returns the user metadata persisted alongside an object body.
+// It must only be called once the body was read when obj.MetaAfterBody is
+// set. Entries of obj.Meta never override the fields below.
+func encodeMetadata(obj Object) map[string]string {
+	meta := map[string]string{}
+	for k, v := range obj.Meta {
+		meta[k] = v
+	}
+	if obj.MetaAfterBody != nil {
+		for k, v := range obj.MetaAfterBody() {
+			meta[k] = v
+		}
+	}
+	if !obj.UpdatedAt.IsZero() {
+		meta[updatedAtMetaKey] = strconv.FormatInt(obj.UpdatedAt.Unix(), 10)
+	}
+	if obj.ETag != "" {
+		meta[etagMetaKey] = obj.ETag
+	}
+	if obj.Checksum != "" {
+		meta[checksumMetaKey] = obj.Checksum
+	}
+	if len(obj.Header) > 0 {
+		meta[headersMetaKey] = encodeHeaders(obj.Header)
+	}
+	return meta
+}
+
+// decodeMetadata fills the fields of obj that are persisted as user metadata.
+func decodeMetadata(meta map[string]string, obj *Object) {
+	obj.UpdatedAt = parseUpdatedAt(meta)
+	obj.ETag = meta[etagMetaKey]
+	obj.Checksum = meta[checksumMetaKey]
+	obj.Header = decodeHeaders(meta[headersMetaKey])
+	obj.Meta = nil
+	for k, v := range meta {
+		switch k {
+		case updatedAtMetaKey, etagMetaKey, checksumMetaKey, headersMetaKey:
+			continue
+		}
+		if obj.Meta == nil {
+			obj.Meta = map[string]string{}
+		}
+		obj.Meta[k] = v
+	}
+}
+
+func parseUpdatedAt(meta map[string]string) time.Time {
+	if meta == nil {
+		return time.Time{}
+	}
+	val, ok := meta[updatedAtMetaKey]
+	if !ok {
+		return time.Time{}
+	}
+	unix, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
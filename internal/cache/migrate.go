@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type MigrateOptions struct {
+	// Delete removes legacy objects once their current key is up to date.
+	Delete bool
+	// DryRun only counts what would be copied or deleted.
+	DryRun  bool
+	Workers int
+	// KeyPrefix is the namespace the current keys live under; see PrefixKey.
+	// Legacy keys never had one.
+	KeyPrefix string
+	// Progress, if set, is called after every object with the running totals.
+	Progress func(MigrateStats)
+}
+
+type MigrateStats struct {
+	Scanned int64
+	Copied  int64
+	Skipped int64
+	Deleted int64
+	Invalid int64
+}
+
+// MigrateKeys copies objects from the legacy "page/" layout to their PageKey.
+// Copies are server side and keep the original metadata. A destination that
+// is at least as recent as its source is left alone, so the migration can run
+// while old and new versions serve traffic, and be repeated after a rollout
+// to pick up pages refreshed under the legacy key in the meantime.
+func (s *S3Store) MigrateKeys(ctx context.Context, opts MigrateOptions) (MigrateStats, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		stats    MigrateStats
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	keys := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				err := s.migrateKey(ctx, key, opts, &stats)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+				if opts.Progress != nil {
+					opts.Progress(loadStats(&stats))
+				}
+			}
+		}()
+	}
+
+	var listErr error
+	listOpts := ListOptions{Prefix: legacyPagePrefix}
+list:
+	for {
+		page, err := s.List(ctx, listOpts)
+		if err != nil {
+			listErr = err
+			break
+		}
+		for _, entry := range page.Entries {
+			select {
+			case keys <- entry.Key:
+			case <-ctx.Done():
+				listErr = ctx.Err()
+				break list
+			}
+		}
+		if page.Cursor == "" {
+			break
+		}
+		listOpts.Cursor = page.Cursor
+	}
+	close(keys)
+	wg.Wait()
+
+	if listErr != nil {
+		return loadStats(&stats), listErr
+	}
+	return loadStats(&stats), firstErr
+}
+
+func (s *S3Store) migrateKey(ctx context.Context, src string, opts MigrateOptions, stats *MigrateStats) error {
+	atomic.AddInt64(&stats.Scanned, 1)
+	variant, title, ok := ParseLegacyPageKey(src)
+	if !ok {
+		atomic.AddInt64(&stats.Invalid, 1)
+		return nil
+	}
+	dst := PrefixKey(opts.KeyPrefix, PageKey(variant, title))
+
+	srcUpdated, err := s.UpdatedAt(ctx, src)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a purge while we were listing.
+			atomic.AddInt64(&stats.Skipped, 1)
+			return nil
+		}
+		return err
+	}
+	dstUpdated, err := s.UpdatedAt(ctx, dst)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err == nil && !dstUpdated.Before(srcUpdated) {
+		atomic.AddInt64(&stats.Skipped, 1)
+	} else {
+		if !opts.DryRun {
+			_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+				Bucket:     aws.String(s.bucket),
+				Key:        aws.String(dst),
+				CopySource: s.copySource(src),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		atomic.AddInt64(&stats.Copied, 1)
+	}
+
+	if opts.Delete {
+		if !opts.DryRun {
+			if err := s.Delete(ctx, src); err != nil {
+				return err
+			}
+		}
+		atomic.AddInt64(&stats.Deleted, 1)
+	}
+	return nil
+}
+
+func loadStats(stats *MigrateStats) MigrateStats {
+	return MigrateStats{
+		Scanned: atomic.LoadInt64(&stats.Scanned),
+		Copied:  atomic.LoadInt64(&stats.Copied),
+		Skipped: atomic.LoadInt64(&stats.Skipped),
+		Deleted: atomic.LoadInt64(&stats.Deleted),
+		Invalid: atomic.LoadInt64(&stats.Invalid),
+	}
+}
@@ -0,0 +1,274 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorQueueSize = 1024
+	mirrorWorkers   = 4
+	mirrorTimeout   = 5 * time.Minute
+)
+
+// MirrorStore writes to a primary Store and one or more secondaries, and reads
+// from the primary with a fallback to the secondaries. In sync mode Put
+// streams the body to every store at once; in async mode the secondaries are
+// copied from the primary in the background. Deletes always reach every store
+// so that a fallback read never brings back a purged page, and background
+// copies of a key deleted in the meantime are undone.
+type MirrorStore struct {
+	primary     Store
+	secondaries []Store
+	async       bool
+	backfill    bool
+	copies      chan mirrorCopy
+
+	mu      sync.Mutex
+	pending map[string]*mirrorPending
+}
+
+type mirrorCopy struct {
+	key      string
+	from, to Store
+	gen      uint64
+}
+
+// mirrorPending tracks the queued and running copies of one key. gen is
+// bumped by every Delete of the key, so that a copy which started before the
+// delete does not leave the object behind.
+type mirrorPending struct {
+	gen  uint64
+	refs int
+}
+
+// NewMirrorStore wraps primary and secondaries. With backfill, objects only
+// found on a secondary are copied back to the primary in the background.
+func NewMirrorStore(primary Store, secondaries []Store, async, backfill bool) *MirrorStore {
+	s := &MirrorStore{
+		primary:     primary,
+		secondaries: secondaries,
+		async:       async,
+		backfill:    backfill,
+		pending:     make(map[string]*mirrorPending),
+	}
+	if async || backfill {
+		s.copies = make(chan mirrorCopy, mirrorQueueSize)
+		for range mirrorWorkers {
+			go s.copyLoop()
+		}
+	}
+	return s
+}
+
+func (s *MirrorStore) Get(ctx context.Context, key string) (Object, error) {
+	obj, err := s.primary.Get(ctx, key)
+	if err == nil {
+		return obj, nil
+	}
+	for _, secondary := range s.secondaries {
+		obj, secErr := secondary.Get(ctx, key)
+		if secErr != nil {
+			continue
+		}
+		if s.backfill && errors.Is(err, ErrNotFound) {
+			s.enqueue(mirrorCopy{key: key, from: secondary, to: s.primary})
+		}
+		return obj, nil
+	}
+	return Object{}, err
+}
+
+func (s *MirrorStore) Head(ctx context.Context, key string) (Object, error) {
+	obj, err := s.primary.Head(ctx, key)
+	if err == nil {
+		return obj, nil
+	}
+	for _, secondary := range s.secondaries {
+		if obj, secErr := secondary.Head(ctx, key); secErr == nil {
+			return obj, nil
+		}
+	}
+	return Object{}, err
+}
+
+func (s *MirrorStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	updatedAt, err := s.primary.UpdatedAt(ctx, key)
+	if err == nil {
+		return updatedAt, nil
+	}
+	for _, secondary := range s.secondaries {
+		if updatedAt, secErr := secondary.UpdatedAt(ctx, key); secErr == nil {
+			return updatedAt, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Put only reports errors from the primary; failed secondary writes are
+// logged.
+func (s *MirrorStore) Put(ctx context.Context, key string, obj Object) error {
+	if s.async {
+		if err := s.primary.Put(ctx, key, obj); err != nil {
+			return err
+		}
+		for _, secondary := range s.secondaries {
+			s.enqueue(mirrorCopy{key: key, from: s.primary, to: secondary})
+		}
+		return nil
+	}
+
+	writers := make([]io.Writer, len(s.secondaries))
+	pipes := make([]*io.PipeWriter, len(s.secondaries))
+	var wg sync.WaitGroup
+	for i, secondary := range s.secondaries {
+		pr, pw := io.Pipe()
+		writers[i] = &mirrorWriter{w: pw}
+		pipes[i] = pw
+		wg.Go(func() {
+			dup := obj
+			dup.Body = pr
+			err := secondary.Put(ctx, key, dup)
+			if err != nil {
+				log.Printf("mirror: put %s: %v", key, err)
+				err = errMirrorAborted
+			}
+			// Unblock the primary if the secondary stopped reading early.
+			pr.CloseWithError(err)
+		})
+	}
+
+	primary := obj
+	primary.Body = io.NopCloser(io.TeeReader(obj.Body, io.MultiWriter(writers...)))
+	err := s.primary.Put(ctx, key, primary)
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	return err
+}
+
+func (s *MirrorStore) Delete(ctx context.Context, key string) error {
+	s.deleted(key)
+	errs := []error{s.primary.Delete(ctx, key)}
+	for _, secondary := range s.secondaries {
+		errs = append(errs, secondary.Delete(ctx, key))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MirrorStore) DeleteMany(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		s.deleted(key)
+	}
+	errs := []error{DeleteMany(ctx, s.primary, keys)}
+	for _, secondary := range s.secondaries {
+		errs = append(errs, DeleteMany(ctx, secondary, keys))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MirrorStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return List(ctx, s.primary, opts)
+}
+
+func (s *MirrorStore) enqueue(c mirrorCopy) {
+	c.gen = s.begin(c.key)
+	select {
+	case s.copies <- c:
+	default:
+		s.end(c.key)
+		log.Printf("mirror: copy queue full, dropping %s", c.key)
+	}
+}
+
+func (s *MirrorStore) copyLoop() {
+	for c := range s.copies {
+		if err := s.copyObject(c); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("mirror: copy %s: %v", c.key, err)
+		}
+		s.end(c.key)
+	}
+}
+
+func (s *MirrorStore) copyObject(c mirrorCopy) error {
+	if s.gen(c.key) != c.gen {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	obj, err := c.from.Get(ctx, c.key)
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	if err := c.to.Put(ctx, c.key, obj); err != nil {
+		return err
+	}
+	if s.gen(c.key) != c.gen {
+		// The key was deleted while it was being copied, possibly before
+		// the copy landed.
+		return c.to.Delete(ctx, c.key)
+	}
+	return nil
+}
+
+func (s *MirrorStore) begin(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[key]
+	if !ok {
+		p = &mirrorPending{}
+		s.pending[key] = p
+	}
+	p.refs++
+	return p.gen
+}
+
+func (s *MirrorStore) end(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pending[key]; ok {
+		if p.refs--; p.refs == 0 {
+			delete(s.pending, key)
+		}
+	}
+}
+
+func (s *MirrorStore) gen(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pending[key]; ok {
+		return p.gen
+	}
+	return 0
+}
+
+// deleted invalidates the pending copies of key. It runs before the stores
+// are deleted from, so a copy that lands afterwards sees the new generation.
+func (s *MirrorStore) deleted(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pending[key]; ok {
+		p.gen++
+	}
+}
+
+var errMirrorAborted = errors.New("mirror write aborted")
+
+// mirrorWriter drops a secondary once it fails instead of failing the tee.
+type mirrorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *mirrorWriter) Write(p []byte) (int, error) {
+	if m.err == nil {
+		_, m.err = m.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestMirrorStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewMirrorStore(cache.NewMemoryStore(), []cache.Store{cache.NewMemoryStore()}, false, false)
+	})
+}
+
+func TestMirrorStoreSyncWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := cache.NewMemoryStore(), cache.NewMemoryStore()
+	s := cache.NewMirrorStore(primary, []cache.Store{secondary}, false, false)
+	body := strings.Repeat("a", 100000)
+	err := s.Put(ctx, "page", cache.Object{Body: io.NopCloser(strings.NewReader(body)), Size: int64(len(body))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []cache.Store{primary, secondary} {
+		if got := readBody(t, store, "page"); got != body {
+			t.Errorf("mirrored body has %d bytes, want %d", len(got), len(body))
+		}
+	}
+
+	if err := s.Delete(ctx, "page"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Head(ctx, "page"); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("secondary kept a deleted object: %v", err)
+	}
+}
+
+func TestMirrorStoreFallbackAndBackfill(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := cache.NewMemoryStore(), cache.NewMemoryStore()
+	err := secondary.Put(ctx, "page", cache.Object{Body: io.NopCloser(strings.NewReader("old bucket")), Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := cache.NewMirrorStore(primary, []cache.Store{secondary}, true, true)
+	if got := readBody(t, s, "page"); got != "old bucket" {
+		t.Fatalf("fallback body = %q", got)
+	}
+	waitFor(t, func() bool {
+		_, err := primary.Head(ctx, "page")
+		return err == nil
+	})
+
+	err = s.Put(ctx, "new", cache.Object{Body: io.NopCloser(strings.NewReader("x")), Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := secondary.Head(ctx, "new")
+		return err == nil
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// gatedPutStore holds its one Put until release is closed, closing started
+// when it arrives and done when it has finished.
+type gatedPutStore struct {
+	cache.Store
+	started chan struct{}
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (s *gatedPutStore) Put(ctx context.Context, key string, obj cache.Object) error {
+	close(s.started)
+	<-s.release
+	defer close(s.done)
+	return s.Store.Put(ctx, key, obj)
+}
+
+func TestMirrorStoreDeleteDuringAsyncCopy(t *testing.T) {
+	ctx := context.Background()
+	secondary := &gatedPutStore{
+		Store:   cache.NewMemoryStore(),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s := cache.NewMirrorStore(cache.NewMemoryStore(), []cache.Store{secondary}, true, false)
+	err := s.Put(ctx, "page", cache.Object{Body: io.NopCloser(strings.NewReader("x")), Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-secondary.started
+	if err := s.Delete(ctx, "page"); err != nil {
+		t.Fatal(err)
+	}
+	close(secondary.release)
+	<-secondary.done
+
+	// The copy landed after the delete and has to be undone.
+	waitFor(t, func() bool {
+		_, err := secondary.Head(ctx, "page")
+		return errors.Is(err, cache.ErrNotFound)
+	})
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// PrefixKey returns key placed under namespace, or key itself for an empty
+// namespace.
+func PrefixKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// PrefixStore keeps every key of the wrapped Store under a namespace, so
+// several wikis or environments can share a bucket. Callers only see keys
+// relative to the namespace.
+type PrefixStore struct {
+	next   Store
+	prefix string
+}
+
+func NewPrefixStore(next Store, namespace string) *PrefixStore {
+	return &PrefixStore{next: next, prefix: PrefixKey(namespace, "")}
+}
+
+func (s *PrefixStore) Get(ctx context.Context, key string) (Object, error) {
+	return s.next.Get(ctx, s.prefix+key)
+}
+
+func (s *PrefixStore) Head(ctx context.Context, key string) (Object, error) {
+	return s.next.Head(ctx, s.prefix+key)
+}
+
+func (s *PrefixStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	return s.next.UpdatedAt(ctx, s.prefix+key)
+}
+
+func (s *PrefixStore) Put(ctx context.Context, key string, obj Object) error {
+	return s.next.Put(ctx, s.prefix+key, obj)
+}
+
+func (s *PrefixStore) Delete(ctx context.Context, key string) error {
+	return s.next.Delete(ctx, s.prefix+key)
+}
+
+func (s *PrefixStore) DeleteMany(ctx context.Context, keys []string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+	return DeleteMany(ctx, s.next, prefixed)
+}
+
+// List passes cursors through unchanged, since they are opaque to everyone
+// but the wrapped Store.
+func (s *PrefixStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	opts.Prefix = s.prefix + opts.Prefix
+	page, err := List(ctx, s.next, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	for i := range page.Entries {
+		page.Entries[i].Key = strings.TrimPrefix(page.Entries[i].Key, s.prefix)
+	}
+	return page, nil
+}
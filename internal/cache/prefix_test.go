@@ -0,0 +1,81 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestPrefixStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewPrefixStore(cache.NewMemoryStore(), "staging")
+	})
+}
+
+func TestPrefixStoreIsolation(t *testing.T) {
+	ctx := context.Background()
+	bucket := cache.NewMemoryStore()
+	prod := cache.NewPrefixStore(bucket, "prod")
+	staging := cache.NewPrefixStore(bucket, "staging")
+
+	key := cache.PageKey("zh", "Pikachu")
+	if err := prod.Put(ctx, key, cache.Object{Body: io.NopCloser(strings.NewReader("prod")), Size: 4, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := staging.Get(ctx, key); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("staging sees prod's object: %v", err)
+	}
+	if _, err := bucket.Head(ctx, "prod/"+key); err != nil {
+		t.Errorf("object not stored under the prefix: %v", err)
+	}
+
+	page, err := prod.List(ctx, cache.ListOptions{Prefix: "v1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Key != key {
+		t.Errorf("List = %+v, want %q", page.Entries, key)
+	}
+	page, err = staging.List(ctx, cache.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 0 {
+		t.Errorf("staging lists prod's objects: %+v", page.Entries)
+	}
+}
+
+// tokenStore hands out cursors that are not keys, like S3 continuation
+// tokens, and rejects any it did not issue.
+type tokenStore struct {
+	*cache.MemoryStore
+}
+
+func (s tokenStore) List(ctx context.Context, opts cache.ListOptions) (cache.ListPage, error) {
+	if opts.Cursor != "" {
+		cursor, err := base64.StdEncoding.DecodeString(opts.Cursor)
+		if err != nil {
+			return cache.ListPage{}, fmt.Errorf("invalid continuation token %q", opts.Cursor)
+		}
+		opts.Cursor = string(cursor)
+	}
+	page, err := s.MemoryStore.List(ctx, opts)
+	if page.Cursor != "" {
+		page.Cursor = base64.StdEncoding.EncodeToString([]byte(page.Cursor))
+	}
+	return page, err
+}
+
+func TestPrefixStoreOpaqueCursor(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewPrefixStore(tokenStore{cache.NewMemoryStore()}, "prod")
+	})
+}
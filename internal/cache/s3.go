@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"strconv"
+	"net/url"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -14,7 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-const updatedAtMetaKey = "updated_at"
+const maxDeleteBatch = 1000
 
 type S3Store struct {
 	bucket   string
@@ -41,19 +42,15 @@ func (s *S3Store) Get(ctx context.Context, key string) (Object, error) {
 		}
 		return Object{}, err
 	}
-	defer out.Body.Close()
 
-	body, err := io.ReadAll(out.Body)
-	if err != nil {
-		return Object{}, err
-	}
-
-	return Object{
-		Body:        body,
+	obj := Object{
+		Body:        out.Body,
+		Size:        aws.ToInt64(out.ContentLength),
 		ContentType: aws.ToString(out.ContentType),
 		Encoding:    aws.ToString(out.ContentEncoding),
-		UpdatedAt:   parseUpdatedAt(out.Metadata),
-	}, nil
+	}
+	decodeMetadata(out.Metadata, &obj)
+	return verifyBody(obj), nil
 }
 
 func (s *S3Store) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
@@ -70,23 +67,82 @@ func (s *S3Store) UpdatedAt(ctx context.Context, key string) (time.Time, error)
 	return parseUpdatedAt(out.Metadata), nil
 }
 
+func (s *S3Store) Head(ctx context.Context, key string) (Object, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return Object{}, ErrNotFound
+		}
+		return Object{}, err
+	}
+
+	obj := Object{
+		Size:        aws.ToInt64(out.ContentLength),
+		ContentType: aws.ToString(out.ContentType),
+		Encoding:    aws.ToString(out.ContentEncoding),
+	}
+	decodeMetadata(out.Metadata, &obj)
+	return obj, nil
+}
+
+// Put uploads obj. S3 metadata has to be sent before the body, so bodies that
+// fit in a single part are buffered to compute the ETag, checksum and
+// MetaAfterBody first; larger bodies are streamed as a multipart upload and
+// get them written afterwards with an in-place copy. The upload already
+// carries updated_at, so the object ages correctly in between; if the copy
+// fails, the object, which has no ETag or checksum, is deleted.
 func (s *S3Store) Put(ctx context.Context, key string, obj Object) error {
-	meta := map[string]string{}
-	if !obj.UpdatedAt.IsZero() {
-		meta[updatedAtMetaKey] = strconv.FormatInt(obj.UpdatedAt.Unix(), 10)
+	body := newHashingReader(&sizedReader{r: obj.Body, size: obj.Size})
+	var head bytes.Buffer
+	if _, err := head.ReadFrom(io.LimitReader(body, s.uploader.PartSize)); err != nil {
+		return err
+	}
+	if int64(head.Len()) < s.uploader.PartSize {
+		obj.ETag = body.ETag()
+		obj.Checksum = body.Checksum()
+		_, err := s.client.PutObject(ctx, s.putInput(key, obj, bytes.NewReader(head.Bytes())))
+		return err
 	}
 
-	input := &s3.PutObjectInput{
+	metaAfterBody := obj.MetaAfterBody
+	obj.ETag = ""
+	obj.Checksum = ""
+	obj.MetaAfterBody = nil
+	if _, err := s.uploader.Upload(ctx, s.putInput(key, obj, io.MultiReader(&head, body))); err != nil {
+		return err
+	}
+	obj.ETag = body.ETag()
+	obj.Checksum = body.Checksum()
+	obj.MetaAfterBody = metaAfterBody
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        s.copySource(key),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		ContentType:       aws.String(obj.ContentType),
+		ContentEncoding:   aws.String(obj.Encoding),
+		Metadata:          encodeMetadata(obj),
+	})
+	if err != nil {
+		// The request context may be what failed the copy.
+		_ = s.Delete(context.WithoutCancel(ctx), key)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) putInput(key string, obj Object, body io.Reader) *s3.PutObjectInput {
+	return &s3.PutObjectInput{
 		Bucket:          aws.String(s.bucket),
 		Key:             aws.String(key),
-		Body:            bytes.NewReader(obj.Body),
+		Body:            body,
 		ContentType:     aws.String(obj.ContentType),
 		ContentEncoding: aws.String(obj.Encoding),
-		Metadata:        meta,
+		Metadata:        encodeMetadata(obj),
 	}
-
-	_, err := s.uploader.Upload(ctx, input)
-	return err
 }
 
 func (s *S3Store) Delete(ctx context.Context, key string) error {
@@ -97,19 +153,65 @@ func (s *S3Store) Delete(ctx context.Context, key string) error {
 	return err
 }
 
-func parseUpdatedAt(meta map[string]string) time.Time {
-	if meta == nil {
-		return time.Time{}
+// DeleteMany deletes keys with DeleteObjects, up to 1000 keys per request.
+func (s *S3Store) DeleteMany(ctx context.Context, keys []string) error {
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		batch := keys[start:min(start+maxDeleteBatch, len(keys))]
+		ids := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("delete %s: %s: %s (%d keys failed)",
+				aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message), len(out.Errors))
+		}
 	}
-	val, ok := meta[updatedAtMetaKey]
-	if !ok {
-		return time.Time{}
+	return nil
+}
+
+// List lists objects with ListObjectsV2. UpdatedAt is the object's
+// LastModified time, which avoids a HEAD request per entry; it matches the
+// updated_at metadata except for objects copied by MigrateKeys.
+func (s *S3Store) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(opts.Prefix),
+	}
+	if opts.Cursor != "" {
+		input.ContinuationToken = aws.String(opts.Cursor)
+	}
+	if opts.Limit > 0 {
+		input.MaxKeys = aws.Int32(int32(min(opts.Limit, 1000)))
 	}
-	unix, err := strconv.ParseInt(val, 10, 64)
+	out, err := s.client.ListObjectsV2(ctx, input)
 	if err != nil {
-		return time.Time{}
+		return ListPage{}, err
 	}
-	return time.Unix(unix, 0)
+
+	page := ListPage{Entries: make([]Entry, 0, len(out.Contents))}
+	for _, obj := range out.Contents {
+		page.Entries = append(page.Entries, Entry{
+			Key:       aws.ToString(obj.Key),
+			Size:      aws.ToInt64(obj.Size),
+			UpdatedAt: aws.ToTime(obj.LastModified),
+		})
+	}
+	if aws.ToBool(out.IsTruncated) {
+		page.Cursor = aws.ToString(out.NextContinuationToken)
+	}
+	return page, nil
+}
+
+func (s *S3Store) copySource(key string) *string {
+	return aws.String((&url.URL{Path: s.bucket + "/" + key}).EscapedPath())
 }
 
 func isNotFound(err error) bool {
@@ -117,5 +219,7 @@ func isNotFound(err error) bool {
 	if errors.As(err, &nsk) {
 		return true
 	}
-	return false
+	// HeadObject has no body to carry NoSuchKey and reports a bare 404.
+	var nf *types.NotFound
+	return errors.As(err, &nf)
 }
@@ -0,0 +1,305 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TestS3Store runs against a real bucket, e.g. a local MinIO, configured with
+// INAZUMA_TEST_S3_ENDPOINT, INAZUMA_TEST_S3_BUCKET,
+// INAZUMA_TEST_S3_ACCESS_KEY and INAZUMA_TEST_S3_SECRET_KEY.
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("INAZUMA_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("INAZUMA_TEST_S3_ENDPOINT not set")
+	}
+	region := os.Getenv("INAZUMA_TEST_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	client := s3.New(s3.Options{
+		Region:       region,
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials: credentials.NewStaticCredentialsProvider(
+			os.Getenv("INAZUMA_TEST_S3_ACCESS_KEY"),
+			os.Getenv("INAZUMA_TEST_S3_SECRET_KEY"),
+			"",
+		),
+	})
+	store := cache.NewS3Store(os.Getenv("INAZUMA_TEST_S3_BUCKET"), client)
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		t.Cleanup(func() { cleanup(t, store) })
+		return store
+	})
+}
+
+func cleanup(t *testing.T, store *cache.S3Store) {
+	ctx := context.Background()
+	opts := cache.ListOptions{Prefix: "cachetest/"}
+	for {
+		page, err := store.List(ctx, opts)
+		if err != nil {
+			t.Logf("cleanup: %v", err)
+			return
+		}
+		var keys []string
+		for _, e := range page.Entries {
+			keys = append(keys, e.Key)
+		}
+		if err := store.DeleteMany(ctx, keys); err != nil {
+			t.Logf("cleanup: %v", err)
+		}
+		if page.Cursor == "" {
+			return
+		}
+		opts.Cursor = page.Cursor
+	}
+}
+
+// TestS3StoreFake runs the conformance tests against an in-process fake of
+// the S3 API, so the multipart path is covered without a bucket.
+func TestS3StoreFake(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		store, _ := newFakeS3Store(t)
+		return store
+	})
+}
+
+func TestS3StoreFailedCopyDeletesUpload(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newFakeS3Store(t)
+	fake.failCopy = true
+	err := store.Put(ctx, "page/zh/Pikachu", cache.Object{
+		Body:        io.NopCloser(bytes.NewReader(make([]byte, 6<<20))),
+		Size:        -1,
+		ContentType: "text/html; charset=UTF-8",
+		UpdatedAt:   time.Unix(1700000000, 0),
+	})
+	if err == nil {
+		t.Fatal("Put succeeded although the copy failed")
+	}
+	if got := fake.uploadedMeta.Get("X-Amz-Meta-Updated_at"); got != "1700000000" {
+		t.Errorf("multipart upload updated_at = %q, want it sent with the upload", got)
+	}
+	if _, err := store.Head(ctx, "page/zh/Pikachu"); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Head after a failed copy = %v, want ErrNotFound", err)
+	}
+}
+
+func newFakeS3Store(t *testing.T) (*cache.S3Store, *fakeS3) {
+	fake := &fakeS3{objects: map[string]fakeS3Object{}, uploads: map[string]*fakeS3Upload{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:                     "us-east-1",
+		BaseEndpoint:               aws.String(srv.URL),
+		UsePathStyle:               true,
+		Credentials:                credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenRequired,
+	})
+	return cache.NewS3Store("bucket", client), fake
+}
+
+// fakeS3 implements the part of the S3 API that S3Store uses, for a single
+// path-style bucket.
+type fakeS3 struct {
+	// failCopy makes CopyObject fail.
+	failCopy bool
+	// uploadedMeta is the header of the last CreateMultipartUpload.
+	uploadedMeta http.Header
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	uploads map[string]*fakeS3Upload
+	nextID  int
+}
+
+type fakeS3Object struct {
+	header http.Header
+	body   []byte
+}
+
+type fakeS3Upload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	q := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q)
+	case key == "" && r.Method == http.MethodPost && q.Has("delete"):
+		var req struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, o := range req.Objects {
+			delete(f.objects, o.Key)
+		}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeS3Upload{key: key, header: objectHeader(r.Header), parts: map[int][]byte{}}
+		f.uploadedMeta = objectHeader(r.Header)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[q.Get("uploadId")].parts[n] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		u := f.uploads[q.Get("uploadId")]
+		delete(f.uploads, q.Get("uploadId"))
+		var all []byte
+		for _, n := range slices.Sorted(maps.Keys(u.parts)) {
+			all = append(all, u.parts[n]...)
+		}
+		f.objects[u.key] = fakeS3Object{header: u.header, body: all}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: u.key, ETag: etag(all)})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, ok := f.objects[key]
+		if f.failCopy || !ok {
+			s3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		f.objects[key] = fakeS3Object{header: objectHeader(r.Header), body: src.body}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: etag(src.body)})
+	case r.Method == http.MethodPut:
+		f.objects[key] = fakeS3Object{header: objectHeader(r.Header), body: body}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		w.Header().Set("ETag", etag(obj.body))
+		w.Write(obj.body)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	type entry struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		Contents              []entry
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	prefix, after := q.Get("prefix"), q.Get("continuation-token")
+	limit, err := strconv.Atoi(q.Get("max-keys"))
+	if err != nil {
+		limit = 1000
+	}
+	for _, key := range slices.Sorted(maps.Keys(f.objects)) {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if len(result.Contents) == limit {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[limit-1].Key
+			break
+		}
+		result.Contents = append(result.Contents, entry{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			Size:         len(f.objects[key].body),
+		})
+	}
+	writeXML(w, result)
+}
+
+// objectHeader keeps the request headers that S3 stores with an object.
+func objectHeader(h http.Header) http.Header {
+	kept := http.Header{}
+	for k, v := range h {
+		if k == "Content-Type" || k == "Content-Encoding" || strings.HasPrefix(k, "X-Amz-Meta-") {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
@@ -3,21 +3,109 @@ package cache
 import (
 	"context"
 	"errors"
+	"io"
+	"net/http"
 	"time"
 )
 
 var ErrNotFound = errors.New("cache object not found")
 
+// ErrCorrupted is returned while reading a body that does not match the
+// checksum recorded when it was stored, or by Get and Head for an object that
+// cannot be read at all, such as one with a damaged data key.
+var ErrCorrupted = errors.New("cache object corrupted")
+
+// Object is a cached page. Bodies are streamed: the caller of Get must close
+// Body, while Put reads Body until EOF and leaves closing it to the caller.
+// Size is the body length in bytes, or -1 when it is not known in advance.
+// ETag and Checksum are hashes of the stored body computed by the Store on
+// Put; they are ignored when passed to Put. Stores verify Checksum while Body
+// is read; Verified is set on bodies that were already verified, such as
+// those served from memory. Header holds upstream response headers replayed
+// with the object; see CaptureHeaders. Meta carries extra metadata for Store
+// wrappers; keys must be lowercase. MetaAfterBody, if set, is called by Put
+// once Body has been read to EOF, and its entries are added to Meta.
 type Object struct {
-	Body        []byte
+	Body        io.ReadCloser
+	Size        int64
 	ContentType string
 	Encoding    string
 	UpdatedAt   time.Time
+	ETag        string
+	Checksum    string
+	Verified    bool
+	Header      http.Header
+	Meta        map[string]string
+
+	MetaAfterBody func() map[string]string
 }
 
+// Store persists cached pages. Put must only commit the object once Body has
+// been read to EOF without error; a failed or truncated read leaves any
+// previous object under key untouched.
 type Store interface {
 	Get(ctx context.Context, key string) (Object, error)
 	Put(ctx context.Context, key string, obj Object) error
 	UpdatedAt(ctx context.Context, key string) (time.Time, error)
+	// Head returns the object under key without its body.
+	Head(ctx context.Context, key string) (Object, error)
 	Delete(ctx context.Context, key string) error
 }
+
+// Entry describes an object in a listing.
+type Entry struct {
+	Key       string
+	Size      int64
+	UpdatedAt time.Time
+}
+
+type ListOptions struct {
+	Prefix string
+	// Cursor continues a previous listing; see ListPage.
+	Cursor string
+	// Limit caps the number of entries returned. Stores may return fewer.
+	Limit int
+}
+
+type ListPage struct {
+	Entries []Entry
+	// Cursor is empty on the last page. Cursors are opaque: only the Store
+	// that returned one can interpret it.
+	Cursor string
+}
+
+// Lister is implemented by stores that can enumerate their objects in key
+// order.
+type Lister interface {
+	List(ctx context.Context, opts ListOptions) (ListPage, error)
+}
+
+// List lists s if it implements Lister and fails with errors.ErrUnsupported
+// otherwise.
+func List(ctx context.Context, s Store, opts ListOptions) (ListPage, error) {
+	l, ok := s.(Lister)
+	if !ok {
+		return ListPage{}, errors.ErrUnsupported
+	}
+	return l.List(ctx, opts)
+}
+
+// BatchDeleter is implemented by stores that can delete many objects in one
+// round trip.
+type BatchDeleter interface {
+	DeleteMany(ctx context.Context, keys []string) error
+}
+
+// DeleteMany deletes keys from s, in batches if s implements BatchDeleter and
+// one by one otherwise.
+func DeleteMany(ctx context.Context, s Store, keys []string) error {
+	if bd, ok := s.(BatchDeleter); ok {
+		return bd.DeleteMany(ctx, keys)
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
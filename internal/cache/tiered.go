@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// TieredStore keeps recently read objects in a byte-bounded in-memory LRU in
+// front of another Store. Writes and deletes go straight to the next Store
+// and invalidate the local copy. Expired entries stay until evicted and are
+// served by Get when the next Store fails.
+type TieredStore struct {
+	next     Store
+	maxBytes int64
+	ttl      time.Duration
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	fills   map[string]*tieredFill
+}
+
+// tieredFill tracks the reads of one key that may still insert into the tier.
+// gen is bumped by every Put or Delete of the key, so that a read which
+// started before the write never inserts the outdated object.
+type tieredFill struct {
+	gen  uint64
+	refs int
+}
+
+type tieredEntry struct {
+	key       string
+	obj       Object
+	body      []byte
+	size      int64
+	expiresAt time.Time
+}
+
+// NewTieredStore wraps next with an in-memory tier holding at most maxBytes of
+// object bodies. Entries are kept for ttl, and never past UpdatedAt+maxAge so
+// that expired pages are re-read from next. A maxAge of zero disables the
+// latter bound.
+func NewTieredStore(next Store, maxBytes int64, ttl, maxAge time.Duration) *TieredStore {
+	return &TieredStore{
+		next:     next,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		maxAge:   maxAge,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		fills:    make(map[string]*tieredFill),
+	}
+}
+
+func (s *TieredStore) Get(ctx context.Context, key string) (Object, error) {
+	stale, fresh, ok := s.lookup(key)
+	if fresh {
+		return stale, nil
+	}
+	gen := s.begin(key)
+	obj, err := s.next.Get(ctx, key)
+	if err != nil {
+		s.end(key)
+		if ok && !errors.Is(err, ErrNotFound) {
+			return stale, nil
+		}
+		return Object{}, err
+	}
+	if !s.cacheable(key, obj) {
+		s.end(key)
+		return obj, nil
+	}
+	// Fill the tier as the caller reads the body, so the first reader is
+	// streamed like any other miss.
+	var once sync.Once
+	end := func() { once.Do(func() { s.end(key) }) }
+	capture := &captureReader{r: obj.Body, buf: make([]byte, 0, obj.Size)}
+	capture.done = func() {
+		if int64(len(capture.buf)) == obj.Size {
+			s.insert(key, obj, capture.buf, gen)
+		}
+		end()
+	}
+	obj.Body = readCloser{Reader: capture, Closer: &endCloser{c: obj.Body, end: end}}
+	return obj, nil
+}
+
+func (s *TieredStore) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	if obj, fresh, _ := s.lookup(key); fresh {
+		return obj.UpdatedAt, nil
+	}
+	return s.next.UpdatedAt(ctx, key)
+}
+
+func (s *TieredStore) Head(ctx context.Context, key string) (Object, error) {
+	if obj, fresh, _ := s.lookup(key); fresh {
+		obj.Body = nil
+		return obj, nil
+	}
+	return s.next.Head(ctx, key)
+}
+
+func (s *TieredStore) Put(ctx context.Context, key string, obj Object) error {
+	s.remove(key)
+	defer s.remove(key)
+	return s.next.Put(ctx, key, obj)
+}
+
+func (s *TieredStore) Delete(ctx context.Context, key string) error {
+	s.remove(key)
+	defer s.remove(key)
+	return s.next.Delete(ctx, key)
+}
+
+func (s *TieredStore) DeleteMany(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		s.remove(key)
+	}
+	defer func() {
+		for _, key := range keys {
+			s.remove(key)
+		}
+	}()
+	return DeleteMany(ctx, s.next, keys)
+}
+
+func (s *TieredStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return List(ctx, s.next, opts)
+}
+
+// lookup returns the local copy of key, if any, and whether it is still fresh.
+func (s *TieredStore) lookup(key string) (obj Object, fresh, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return Object{}, false, false
+	}
+	entry := el.Value.(*tieredEntry)
+	s.lru.MoveToFront(el)
+	obj = entry.obj
+	obj.Body = io.NopCloser(bytes.NewReader(entry.body))
+	// Only bodies that passed verification reach EOF and are inserted.
+	obj.Verified = true
+	return obj, time.Now().Before(entry.expiresAt), true
+}
+
+// begin registers a read of key that may insert into the tier and returns
+// the key's current generation. Every begin must be paired with an end.
+func (s *TieredStore) begin(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.fills[key]
+	if !ok {
+		f = &tieredFill{}
+		s.fills[key] = f
+	}
+	f.refs++
+	return f.gen
+}
+
+func (s *TieredStore) end(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.fills[key]; ok {
+		if f.refs--; f.refs == 0 {
+			delete(s.fills, key)
+		}
+	}
+}
+
+func (s *TieredStore) cacheable(key string, obj Object) bool {
+	if obj.UpdatedAt.IsZero() || obj.Size < 0 {
+		return false
+	}
+	return int64(len(key))+obj.Size <= s.maxBytes
+}
+
+// insert stores obj unless a Put or Delete of key happened since gen was
+// read, in which case obj may already be outdated.
+func (s *TieredStore) insert(key string, obj Object, body []byte, gen uint64) {
+	size := int64(len(key) + len(body))
+	obj.Body = nil
+	expiresAt := time.Now().Add(s.ttl)
+	if s.maxAge > 0 {
+		if hard := obj.UpdatedAt.Add(s.maxAge); hard.Before(expiresAt) {
+			expiresAt = hard
+		}
+	}
+	if !time.Now().Before(expiresAt) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.fills[key]; !ok || f.gen != gen {
+		return
+	}
+	if el, ok := s.entries[key]; ok {
+		s.removeElement(el)
+	}
+	s.entries[key] = s.lru.PushFront(&tieredEntry{
+		key:       key,
+		obj:       obj,
+		body:      body,
+		size:      size,
+		expiresAt: expiresAt,
+	})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *TieredStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.fills[key]; ok {
+		f.gen++
+	}
+	if el, ok := s.entries[key]; ok {
+		s.removeElement(el)
+	}
+}
+
+func (s *TieredStore) removeElement(el *list.Element) {
+	entry := el.Value.(*tieredEntry)
+	s.lru.Remove(el)
+	delete(s.entries, entry.key)
+	s.size -= entry.size
+}
+
+// captureReader buffers everything read through it and calls done once the
+// underlying reader reports EOF.
+type captureReader struct {
+	r    io.Reader
+	buf  []byte
+	done func()
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	if err == io.EOF && c.done != nil {
+		c.done()
+		c.done = nil
+	}
+	return n, err
+}
+
+// endCloser calls end when the body is closed, whether or not it was read to
+// the end.
+type endCloser struct {
+	c   io.Closer
+	end func()
+}
+
+func (e *endCloser) Close() error {
+	e.end()
+	return e.c.Close()
+}
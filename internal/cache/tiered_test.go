@@ -0,0 +1,146 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/cache/cachetest"
+)
+
+func TestTieredStore(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Store {
+		return cache.NewTieredStore(cache.NewMemoryStore(), 1<<20, time.Minute, 0)
+	})
+}
+
+// failingStore fails every call while fail is set.
+type failingStore struct {
+	cache.Store
+	fail bool
+}
+
+var errBackend = errors.New("backend down")
+
+func (s *failingStore) Get(ctx context.Context, key string) (cache.Object, error) {
+	if s.fail {
+		return cache.Object{}, errBackend
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func (s *failingStore) Head(ctx context.Context, key string) (cache.Object, error) {
+	if s.fail {
+		return cache.Object{}, errBackend
+	}
+	return s.Store.Head(ctx, key)
+}
+
+func TestTieredStoreServesStaleOnError(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingStore{Store: cache.NewMemoryStore()}
+	s := cache.NewTieredStore(backend, 1<<20, 10*time.Millisecond, 0)
+	err := s.Put(ctx, "page", cache.Object{
+		Body:      io.NopCloser(strings.NewReader("cached")),
+		Size:      6,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, s, "page"); body != "cached" {
+		t.Fatalf("body = %q", body)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	backend.fail = true
+	if body := readBody(t, s, "page"); body != "cached" {
+		t.Errorf("stale body = %q, want %q", body, "cached")
+	}
+	if _, err := s.Head(ctx, "page"); !errors.Is(err, errBackend) {
+		t.Errorf("Head = %v, want the backend error", err)
+	}
+}
+
+func readBody(t *testing.T, s cache.Store, key string) string {
+	t.Helper()
+	obj, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(body)
+}
+
+func TestTieredStoreFillSurvivesUnrelatedWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingStore{Store: cache.NewMemoryStore()}
+	s := cache.NewTieredStore(backend, 1<<20, time.Minute, 0)
+	for _, key := range []string{"page", "other"} {
+		err := s.Put(ctx, key, cache.Object{
+			Body:      io.NopCloser(strings.NewReader("cached")),
+			Size:      6,
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	obj, err := s.Get(ctx, "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(obj.Body); err != nil {
+		t.Fatal(err)
+	}
+	obj.Body.Close()
+
+	backend.fail = true
+	if body := readBody(t, s, "page"); body != "cached" {
+		t.Errorf("body = %q, want it served from the tier", body)
+	}
+}
+
+func TestTieredStoreFillDiscardedAfterWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingStore{Store: cache.NewMemoryStore()}
+	s := cache.NewTieredStore(backend, 1<<20, time.Minute, 0)
+	put := func(body string) {
+		t.Helper()
+		err := s.Put(ctx, "page", cache.Object{
+			Body:      io.NopCloser(strings.NewReader(body)),
+			Size:      int64(len(body)),
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("old")
+
+	obj, err := s.Get(ctx, "page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("new")
+	if _, err := io.ReadAll(obj.Body); err != nil {
+		t.Fatal(err)
+	}
+	obj.Body.Close()
+
+	if body := readBody(t, s, "page"); body != "new" {
+		t.Errorf("body = %q, want %q", body, "new")
+	}
+}
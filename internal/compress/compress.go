@@ -0,0 +1,230 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	Identity = "identity"
+	Gzip     = "gzip"
+	Brotli   = "br"
+)
+
+// Normalize maps a Content-Encoding value to one of the constants above,
+// treating an empty value as identity.
+func Normalize(enc string) string {
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	switch enc {
+	case "", Identity:
+		return Identity
+	case "x-gzip":
+		return Gzip
+	default:
+		return enc
+	}
+}
+
+func Supported(enc string) bool {
+	switch Normalize(enc) {
+	case Identity, Gzip, Brotli:
+		return true
+	default:
+		return false
+	}
+}
+
+// Negotiate picks the content coding to serve for an Accept-Encoding header.
+// preferred wins whenever the client accepts it, so stored bodies can be sent
+// without transcoding; otherwise the best supported coding is used.
+func Negotiate(acceptEncoding, preferred string) string {
+	preferred = Normalize(preferred)
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return Identity
+	}
+
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseCoding(part)
+		if coding == "" {
+			continue
+		}
+		weights[coding] = q
+	}
+	accepts := func(enc string) (float64, bool) {
+		if q, ok := weights[enc]; ok {
+			return q, q > 0
+		}
+		if enc == Identity {
+			if q, ok := weights["*"]; ok && q == 0 {
+				return 0, false
+			}
+			return 0.001, true
+		}
+		q, ok := weights["*"]
+		return q, ok && q > 0
+	}
+
+	if Supported(preferred) {
+		if _, ok := accepts(preferred); ok {
+			return preferred
+		}
+	}
+	best, bestQ := Identity, 0.0
+	for _, enc := range []string{Brotli, Gzip, Identity} {
+		if q, ok := accepts(enc); ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+func parseCoding(part string) (string, float64) {
+	coding := part
+	q := 1.0
+	if idx := strings.Index(part, ";"); idx != -1 {
+		coding = part[:idx]
+		for _, p := range strings.Split(part[idx+1:], ";") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(strings.ToLower(p), "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(p[2:]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	coding = strings.TrimSpace(coding)
+	if coding == "" {
+		return "", 0
+	}
+	if coding == "*" {
+		return coding, q
+	}
+	return Normalize(coding), q
+}
+
+// NewReader decodes r from enc.
+func NewReader(enc string, r io.Reader) (io.ReadCloser, error) {
+	switch Normalize(enc) {
+	case Identity:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Brotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content coding %q", enc)
+	}
+}
+
+// NewWriter encodes into w using enc. Close flushes the encoder but does not
+// close w.
+func NewWriter(enc string, w io.Writer) (io.WriteCloser, error) {
+	switch Normalize(enc) {
+	case Identity:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Brotli:
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content coding %q", enc)
+	}
+}
+
+// NewTranscoder returns a writer that accepts a body encoded with from and
+// writes it to w encoded with to. Close must be called to flush the output; it
+// does not close w.
+func NewTranscoder(w io.Writer, from, to string) (io.WriteCloser, error) {
+	from, to = Normalize(from), Normalize(to)
+	if from == to {
+		return nopWriteCloser{w}, nil
+	}
+	if !Supported(from) {
+		return nil, fmt.Errorf("unsupported content coding %q", from)
+	}
+	if from == Identity {
+		return NewWriter(to, w)
+	}
+	if !Supported(to) {
+		return nil, fmt.Errorf("unsupported content coding %q", to)
+	}
+
+	pr, pw := io.Pipe()
+	t := &transcoder{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decodeTo(w, pr, from, to)
+		// Fail further writes instead of blocking on a dead decoder.
+		pr.CloseWithError(err)
+		t.done <- err
+	}()
+	return t, nil
+}
+
+// TranscodeReader returns r re-encoded from from to to.
+func TranscodeReader(r io.Reader, from, to string) (io.ReadCloser, error) {
+	from, to = Normalize(from), Normalize(to)
+	if from == to {
+		return io.NopCloser(r), nil
+	}
+	if to == Identity {
+		return NewReader(from, r)
+	}
+	if !Supported(from) || !Supported(to) {
+		return nil, fmt.Errorf("cannot transcode %q to %q", from, to)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		t, err := NewTranscoder(pw, from, to)
+		if err == nil {
+			_, err = io.Copy(t, r)
+			if closeErr := t.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func decodeTo(w io.Writer, r io.Reader, from, to string) error {
+	dec, err := NewReader(from, r)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	enc, err := NewWriter(to, w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, dec); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+type transcoder struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (t *transcoder) Write(p []byte) (int, error) {
+	return t.pw.Write(p)
+}
+
+func (t *transcoder) Close() error {
+	t.pw.Close()
+	return <-t.done
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
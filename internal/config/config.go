@@ -2,59 +2,300 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/52poke/inazuma/internal/compress"
+)
+
+const (
+	BackendS3   = "s3"
+	BackendDisk = "disk"
+
+	MirrorSync  = "sync"
+	MirrorAsync = "async"
+
+	LockRedis = "redis"
+	LockLocal = "local"
+
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+var defaultCacheHeaders = []string{
+	"Content-Language",
+	"Link",
+	"X-Content-Type-Options",
+	"Content-Security-Policy",
+	"Content-Security-Policy-Report-Only",
+	"Referrer-Policy",
+	"X-Frame-Options",
+}
+
+// keyPrefixPattern keeps key prefixes to a single segment that is safe both as
+// an S3 key component and in Redis keys. reservedKeyPrefix matches the first
+// segment of unprefixed keys, current and legacy.
+var (
+	keyPrefixPattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+	reservedKeyPrefix = regexp.MustCompile(`^(page|v[0-9]+)$`)
 )
 
 type Config struct {
-	ListenAddr         string
-	MediaWikiBaseURL   string
-	RedisAddr          string
-	RedisDB            int
-	RedisPassword      string
-	S3Endpoint         string
-	S3Region           string
-	S3Bucket           string
-	S3AccessKey        string
-	S3SecretKey        string
-	NginxPurgeURL      string
-	LoggedInCookieName string
-	CacheTTLSeconds    int
-	LockTTLSeconds     int
-	MaxLockWaitSeconds int
+	ListenAddr              string
+	MediaWikiBaseURL        string
+	MediaWikiTimeoutSeconds int
+	LockBackend             string
+	RedisMode               string
+	RedisAddrs              []string
+	RedisDB                 int
+	RedisUsername           string
+	RedisPassword           string
+	RedisMasterName         string
+	RedisSentinelUsername   string
+	RedisSentinelPassword   string
+	RedisTLS                bool
+	RedisTLSCAFile          string
+	RedisTLSCertFile        string
+	RedisTLSKeyFile         string
+	RedisTLSServerName      string
+	CacheBackend            string
+	DiskCacheDir            string
+	S3Endpoint              string
+	S3Region                string
+	S3Bucket                string
+	S3AccessKey             string
+	S3SecretKey             string
+	NginxPurgeURL           string
+	LoggedInCookieName      string
+	CacheTTLSeconds         int
+	LockTTLSeconds          int
+	MaxLockWaitSeconds      int
+	RefreshConcurrency      int
+	RefreshPermitWaitMillis int
+	StorageEncoding         string
+	CacheHeaders            []string
+	MemoryCacheBytes        int64
+	MemoryCacheTTL          int
+	VerifyMaxBytes          int64
+	AdminToken              string
+	GCIntervalSeconds       int
+	GCExpiryMultiple        int
+	BreakerFailures         int
+	BreakerSlowMillis       int
+	BreakerCooldown         int
+	MirrorS3Endpoint        string
+	MirrorS3Region          string
+	MirrorS3Bucket          string
+	MirrorS3AccessKey       string
+	MirrorS3SecretKey       string
+	MirrorDiskDir           string
+	MirrorMode              string
+	MirrorBackfill          bool
+	EncryptionKeys          []string
+	KeyPrefix               string
+	TTLRulesFile            string
+	ExpiryJitterPercent     int
+	EarlyRefreshBeta        float64
 }
 
 func Load() (Config, error) {
 	cfg := Config{
-		ListenAddr:         getenv("INAZUMA_LISTEN_ADDR", ":8080"),
-		MediaWikiBaseURL:   getenv("INAZUMA_MEDIAWIKI_BASE_URL", ""),
-		RedisAddr:          getenv("INAZUMA_REDIS_ADDR", ""),
-		RedisDB:            getenvInt("INAZUMA_REDIS_DB", 0),
-		RedisPassword:      os.Getenv("INAZUMA_REDIS_PASSWORD"),
-		S3Endpoint:         getenv("INAZUMA_S3_ENDPOINT", ""),
-		S3Region:           getenv("INAZUMA_S3_REGION", ""),
-		S3Bucket:           getenv("INAZUMA_S3_BUCKET", ""),
-		S3AccessKey:        os.Getenv("INAZUMA_S3_ACCESS_KEY"),
-		S3SecretKey:        os.Getenv("INAZUMA_S3_SECRET_KEY"),
-		NginxPurgeURL:      getenv("INAZUMA_NGINX_PURGE_URL", ""),
-		LoggedInCookieName: getenv("INAZUMA_LOGGED_IN_COOKIE", "52poke_wikiUserID"),
-		CacheTTLSeconds:    getenvInt("INAZUMA_CACHE_TTL_SECONDS", 2592000),
-		LockTTLSeconds:     getenvInt("INAZUMA_LOCK_TTL_SECONDS", 45),
-		MaxLockWaitSeconds: getenvInt("INAZUMA_MAX_LOCK_WAIT_SECONDS", 3),
+		ListenAddr:              getenv("INAZUMA_LISTEN_ADDR", ":8080"),
+		MediaWikiBaseURL:        getenv("INAZUMA_MEDIAWIKI_BASE_URL", ""),
+		MediaWikiTimeoutSeconds: getenvInt("INAZUMA_MEDIAWIKI_TIMEOUT_SECONDS", 10),
+		LockBackend:             getenv("INAZUMA_LOCK_BACKEND", LockRedis),
+		RedisMode:               getenv("INAZUMA_REDIS_MODE", RedisStandalone),
+		RedisAddrs:              getenvList("INAZUMA_REDIS_ADDR", nil),
+		RedisDB:                 getenvInt("INAZUMA_REDIS_DB", 0),
+		RedisUsername:           os.Getenv("INAZUMA_REDIS_USERNAME"),
+		RedisPassword:           os.Getenv("INAZUMA_REDIS_PASSWORD"),
+		RedisMasterName:         getenv("INAZUMA_REDIS_MASTER_NAME", ""),
+		RedisSentinelUsername:   os.Getenv("INAZUMA_REDIS_SENTINEL_USERNAME"),
+		RedisSentinelPassword:   os.Getenv("INAZUMA_REDIS_SENTINEL_PASSWORD"),
+		RedisTLS:                getenvBool("INAZUMA_REDIS_TLS", false),
+		RedisTLSCAFile:          getenv("INAZUMA_REDIS_TLS_CA_FILE", ""),
+		RedisTLSCertFile:        getenv("INAZUMA_REDIS_TLS_CERT_FILE", ""),
+		RedisTLSKeyFile:         getenv("INAZUMA_REDIS_TLS_KEY_FILE", ""),
+		RedisTLSServerName:      getenv("INAZUMA_REDIS_TLS_SERVER_NAME", ""),
+		CacheBackend:            getenv("INAZUMA_CACHE_BACKEND", BackendS3),
+		DiskCacheDir:            getenv("INAZUMA_DISK_CACHE_DIR", ""),
+		S3Endpoint:              getenv("INAZUMA_S3_ENDPOINT", ""),
+		S3Region:                getenv("INAZUMA_S3_REGION", ""),
+		S3Bucket:                getenv("INAZUMA_S3_BUCKET", ""),
+		S3AccessKey:             os.Getenv("INAZUMA_S3_ACCESS_KEY"),
+		S3SecretKey:             os.Getenv("INAZUMA_S3_SECRET_KEY"),
+		NginxPurgeURL:           getenv("INAZUMA_NGINX_PURGE_URL", ""),
+		LoggedInCookieName:      getenv("INAZUMA_LOGGED_IN_COOKIE", "52poke_wikiUserID"),
+		CacheTTLSeconds:         getenvInt("INAZUMA_CACHE_TTL_SECONDS", 2592000),
+		LockTTLSeconds:          getenvInt("INAZUMA_LOCK_TTL_SECONDS", 45),
+		MaxLockWaitSeconds:      getenvInt("INAZUMA_MAX_LOCK_WAIT_SECONDS", 3),
+		RefreshConcurrency:      getenvInt("INAZUMA_REFRESH_CONCURRENCY", 1),
+		RefreshPermitWaitMillis: getenvInt("INAZUMA_REFRESH_PERMIT_WAIT_MS", 0),
+		StorageEncoding:         getenv("INAZUMA_STORAGE_ENCODING", compress.Gzip),
+		CacheHeaders:            getenvList("INAZUMA_CACHE_HEADERS", defaultCacheHeaders),
+		MemoryCacheBytes:        int64(getenvInt("INAZUMA_MEMORY_CACHE_BYTES", 0)),
+		MemoryCacheTTL:          getenvInt("INAZUMA_MEMORY_CACHE_TTL_SECONDS", 60),
+		VerifyMaxBytes:          int64(getenvInt("INAZUMA_VERIFY_MAX_BYTES", 256<<10)),
+		AdminToken:              os.Getenv("INAZUMA_ADMIN_TOKEN"),
+		GCIntervalSeconds:       getenvInt("INAZUMA_GC_INTERVAL_SECONDS", 0),
+		GCExpiryMultiple:        getenvInt("INAZUMA_GC_EXPIRY_MULTIPLE", 3),
+		BreakerFailures:         getenvInt("INAZUMA_BREAKER_FAILURES", 5),
+		BreakerSlowMillis:       getenvInt("INAZUMA_BREAKER_SLOW_MS", 2000),
+		BreakerCooldown:         getenvInt("INAZUMA_BREAKER_COOLDOWN_SECONDS", 30),
+		MirrorS3Endpoint:        getenv("INAZUMA_MIRROR_S3_ENDPOINT", ""),
+		MirrorS3Region:          getenv("INAZUMA_MIRROR_S3_REGION", ""),
+		MirrorS3Bucket:          getenv("INAZUMA_MIRROR_S3_BUCKET", ""),
+		MirrorS3AccessKey:       os.Getenv("INAZUMA_MIRROR_S3_ACCESS_KEY"),
+		MirrorS3SecretKey:       os.Getenv("INAZUMA_MIRROR_S3_SECRET_KEY"),
+		MirrorDiskDir:           getenv("INAZUMA_MIRROR_DISK_DIR", ""),
+		MirrorMode:              getenv("INAZUMA_MIRROR_MODE", MirrorSync),
+		MirrorBackfill:          getenvBool("INAZUMA_MIRROR_BACKFILL", false),
+		EncryptionKeys:          getenvList("INAZUMA_ENCRYPTION_KEYS", nil),
+		KeyPrefix:               getenv("INAZUMA_KEY_PREFIX", ""),
+		TTLRulesFile:            getenv("INAZUMA_TTL_RULES_FILE", ""),
+		ExpiryJitterPercent:     getenvInt("INAZUMA_EXPIRY_JITTER_PERCENT", 0),
+		EarlyRefreshBeta:        getenvFloat("INAZUMA_EARLY_REFRESH_BETA", 0),
 	}
 
 	if cfg.MediaWikiBaseURL == "" {
 		return cfg, errors.New("INAZUMA_MEDIAWIKI_BASE_URL is required")
 	}
-	if cfg.RedisAddr == "" {
-		return cfg, errors.New("INAZUMA_REDIS_ADDR is required")
+	if cfg.MediaWikiTimeoutSeconds <= 0 {
+		return cfg, errors.New("INAZUMA_MEDIAWIKI_TIMEOUT_SECONDS must be positive")
+	}
+	if cfg.LockTTLSeconds <= 0 {
+		return cfg, errors.New("INAZUMA_LOCK_TTL_SECONDS must be positive")
+	}
+	if cfg.RefreshConcurrency < 1 {
+		return cfg, errors.New("INAZUMA_REFRESH_CONCURRENCY must be at least 1")
 	}
-	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
-		return cfg, errors.New("S3 endpoint/bucket/access/secret are required")
+	if cfg.RefreshPermitWaitMillis < 0 {
+		return cfg, errors.New("INAZUMA_REFRESH_PERMIT_WAIT_MS must not be negative")
+	}
+	switch cfg.LockBackend {
+	case LockRedis:
+		if err := cfg.validateRedis(); err != nil {
+			return cfg, err
+		}
+	case LockLocal:
+	default:
+		return cfg, fmt.Errorf("unknown INAZUMA_LOCK_BACKEND %q", cfg.LockBackend)
+	}
+	if !compress.Supported(cfg.StorageEncoding) {
+		return cfg, fmt.Errorf("unsupported INAZUMA_STORAGE_ENCODING %q", cfg.StorageEncoding)
+	}
+	cfg.StorageEncoding = compress.Normalize(cfg.StorageEncoding)
+
+	if cfg.VerifyMaxBytes < 0 {
+		return cfg, errors.New("INAZUMA_VERIFY_MAX_BYTES must not be negative")
+	}
+	if cfg.GCExpiryMultiple < 1 {
+		return cfg, errors.New("INAZUMA_GC_EXPIRY_MULTIPLE must be at least 1")
+	}
+	if cfg.GCIntervalSeconds > 0 && cfg.CacheTTLSeconds <= 0 {
+		return cfg, errors.New("INAZUMA_GC_INTERVAL_SECONDS requires a positive INAZUMA_CACHE_TTL_SECONDS")
+	}
+	if cfg.BreakerFailures < 0 || cfg.BreakerSlowMillis < 0 || cfg.BreakerCooldown < 0 {
+		return cfg, errors.New("INAZUMA_BREAKER_* settings must not be negative")
+	}
+	if cfg.KeyPrefix != "" && !keyPrefixPattern.MatchString(cfg.KeyPrefix) {
+		return cfg, fmt.Errorf("invalid INAZUMA_KEY_PREFIX %q: use up to 63 letters, digits, '.', '_' or '-'", cfg.KeyPrefix)
+	}
+	if reservedKeyPrefix.MatchString(cfg.KeyPrefix) {
+		return cfg, fmt.Errorf("INAZUMA_KEY_PREFIX %q is reserved for unprefixed keys", cfg.KeyPrefix)
+	}
+	if cfg.ExpiryJitterPercent < 0 || cfg.ExpiryJitterPercent > 100 {
+		return cfg, errors.New("INAZUMA_EXPIRY_JITTER_PERCENT must be between 0 and 100")
+	}
+	if cfg.EarlyRefreshBeta < 0 {
+		return cfg, errors.New("INAZUMA_EARLY_REFRESH_BETA must not be negative")
+	}
+	if cfg.MirrorMode != MirrorSync && cfg.MirrorMode != MirrorAsync {
+		return cfg, fmt.Errorf("unknown INAZUMA_MIRROR_MODE %q", cfg.MirrorMode)
+	}
+	if cfg.MirrorS3Endpoint != "" || cfg.MirrorS3Bucket != "" {
+		if cfg.MirrorS3Endpoint == "" || cfg.MirrorS3Bucket == "" || cfg.MirrorS3AccessKey == "" || cfg.MirrorS3SecretKey == "" {
+			return cfg, errors.New("mirror S3 endpoint/bucket/access/secret are required")
+		}
+	}
+	if path := os.Getenv("INAZUMA_ENCRYPTION_KEYS_FILE"); path != "" {
+		keys, err := readKeysFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("INAZUMA_ENCRYPTION_KEYS_FILE: %w", err)
+		}
+		cfg.EncryptionKeys = append(cfg.EncryptionKeys, keys...)
+	}
+
+	switch cfg.CacheBackend {
+	case BackendS3:
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			return cfg, errors.New("S3 endpoint/bucket/access/secret are required")
+		}
+	case BackendDisk:
+		if cfg.DiskCacheDir == "" {
+			return cfg, errors.New("INAZUMA_DISK_CACHE_DIR is required for the disk backend")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown INAZUMA_CACHE_BACKEND %q", cfg.CacheBackend)
 	}
 	return cfg, nil
 }
 
+func (c Config) validateRedis() error {
+	if len(c.RedisAddrs) == 0 {
+		return errors.New("INAZUMA_REDIS_ADDR is required for the redis lock backend")
+	}
+	switch c.RedisMode {
+	case RedisStandalone:
+		if len(c.RedisAddrs) > 1 {
+			return errors.New("INAZUMA_REDIS_ADDR takes a single address in standalone mode")
+		}
+	case RedisSentinel:
+		if c.RedisMasterName == "" {
+			return errors.New("INAZUMA_REDIS_MASTER_NAME is required in sentinel mode")
+		}
+	case RedisCluster:
+		if c.RedisDB != 0 {
+			return errors.New("INAZUMA_REDIS_DB must be 0 in cluster mode")
+		}
+	default:
+		return fmt.Errorf("unknown INAZUMA_REDIS_MODE %q", c.RedisMode)
+	}
+	if (c.RedisTLSCertFile == "") != (c.RedisTLSKeyFile == "") {
+		return errors.New("INAZUMA_REDIS_TLS_CERT_FILE and INAZUMA_REDIS_TLS_KEY_FILE must be set together")
+	}
+	if !c.RedisTLS && (c.RedisTLSCAFile != "" || c.RedisTLSCertFile != "" || c.RedisTLSServerName != "") {
+		return errors.New("INAZUMA_REDIS_TLS_* settings require INAZUMA_REDIS_TLS")
+	}
+	return nil
+}
+
+// HasMirror reports whether any secondary store is configured.
+func (c Config) HasMirror() bool {
+	return c.MirrorS3Endpoint != "" || c.MirrorDiskDir != ""
+}
+
+// readKeysFile reads one key per line, skipping blank lines and # comments.
+func readKeysFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
 func getenv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -73,3 +314,33 @@ func getenvInt(key string, def int) int {
 	}
 	return n
 }
+
+func getenvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func getenvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func getenvList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package config
+
+import "testing"
+
+func setRequired(t *testing.T) {
+	t.Setenv("INAZUMA_MEDIAWIKI_BASE_URL", "https://wiki.example.com")
+	t.Setenv("INAZUMA_REDIS_ADDR", "localhost:6379")
+	t.Setenv("INAZUMA_CACHE_BACKEND", BackendDisk)
+	t.Setenv("INAZUMA_DISK_CACHE_DIR", t.TempDir())
+}
+
+func TestLoadKeyPrefix(t *testing.T) {
+	for prefix, valid := range map[string]bool{
+		"":               true,
+		"52poke-prod":    true,
+		"wiki.staging_2": true,
+		"-leading":       false,
+		"with/slash":     false,
+		"with:colon":     false,
+		"page":           false,
+		"v1":             false,
+		"v12":            false,
+		"v1beta":         true,
+	} {
+		setRequired(t)
+		t.Setenv("INAZUMA_KEY_PREFIX", prefix)
+		cfg, err := Load()
+		if valid && err != nil {
+			t.Errorf("prefix %q rejected: %v", prefix, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("prefix %q accepted", prefix)
+		}
+		if valid && err == nil && cfg.KeyPrefix != prefix {
+			t.Errorf("KeyPrefix = %q, want %q", cfg.KeyPrefix, prefix)
+		}
+	}
+}
+
+func TestLoadLockBackend(t *testing.T) {
+	setRequired(t)
+	t.Setenv("INAZUMA_REDIS_ADDR", "")
+	if _, err := Load(); err == nil {
+		t.Error("redis lock backend accepted without INAZUMA_REDIS_ADDR")
+	}
+
+	t.Setenv("INAZUMA_LOCK_BACKEND", LockLocal)
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("local lock backend rejected: %v", err)
+	}
+	if cfg.LockBackend != LockLocal {
+		t.Errorf("LockBackend = %q, want %q", cfg.LockBackend, LockLocal)
+	}
+
+	t.Setenv("INAZUMA_LOCK_BACKEND", "etcd")
+	if _, err := Load(); err == nil {
+		t.Error("unknown lock backend accepted")
+	}
+}
+
+func TestLoadRedis(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		env   map[string]string
+		valid bool
+	}{
+		{"standalone", nil, true},
+		{"standalone with several addresses", map[string]string{"INAZUMA_REDIS_ADDR": "a:6379,b:6379"}, false},
+		{"sentinel", map[string]string{
+			"INAZUMA_REDIS_MODE":        RedisSentinel,
+			"INAZUMA_REDIS_ADDR":        "s1:26379, s2:26379",
+			"INAZUMA_REDIS_MASTER_NAME": "mymaster",
+		}, true},
+		{"sentinel without master", map[string]string{"INAZUMA_REDIS_MODE": RedisSentinel}, false},
+		{"cluster", map[string]string{"INAZUMA_REDIS_MODE": RedisCluster, "INAZUMA_REDIS_ADDR": "a:6379,b:6379"}, true},
+		{"cluster with a database", map[string]string{"INAZUMA_REDIS_MODE": RedisCluster, "INAZUMA_REDIS_DB": "1"}, false},
+		{"unknown mode", map[string]string{"INAZUMA_REDIS_MODE": "replica"}, false},
+		{"tls", map[string]string{"INAZUMA_REDIS_TLS": "true", "INAZUMA_REDIS_TLS_SERVER_NAME": "redis.internal"}, true},
+		{"tls files without tls", map[string]string{"INAZUMA_REDIS_TLS_CA_FILE": "/etc/ca.pem"}, false},
+		{"certificate without key", map[string]string{"INAZUMA_REDIS_TLS": "true", "INAZUMA_REDIS_TLS_CERT_FILE": "/etc/cert.pem"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setRequired(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load()
+			if tc.valid && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("accepted")
+			}
+			if tc.name == "sentinel" && len(cfg.RedisAddrs) != 2 {
+				t.Errorf("RedisAddrs = %q", cfg.RedisAddrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/lock"
+)
+
+// Collector deletes objects that have not been refreshed for MaxAge. Pages
+// that are deleted or renamed on the wiki without a purge are never read
+// again, so their objects would otherwise stay in the bucket forever.
+type Collector struct {
+	Cache  cache.Store
+	Locks  lock.Locker
+	MaxAge time.Duration
+	// MaxAgeFor, if set, overrides MaxAge per key. Keys it returns zero for
+	// are never collected.
+	MaxAgeFor func(key string) time.Duration
+	// Prefix limits collection to keys starting with it.
+	Prefix string
+	DryRun bool
+}
+
+type Result struct {
+	Scanned        int64
+	Deleted        int64
+	BytesReclaimed int64
+	Duration       time.Duration
+}
+
+const (
+	runLockKey    = "lock:gc"
+	lastRunKey    = "gc:last-run"
+	runLockTTL    = 5 * time.Minute // kept alive while a run lasts
+	gcListLimit   = 1000
+	maxCheckEvery = time.Hour
+)
+
+// ErrLocked is returned when another replica is already collecting.
+var ErrLocked = errors.New("gc is already running elsewhere")
+
+// Run walks the store once and deletes expired objects.
+func (c *Collector) Run(ctx context.Context) (Result, error) {
+	if c.MaxAge <= 0 && c.MaxAgeFor == nil {
+		return Result{}, errors.New("gc max age must be positive")
+	}
+	start := time.Now()
+
+	var res Result
+	opts := cache.ListOptions{Prefix: c.Prefix, Limit: gcListLimit}
+	for {
+		page, err := cache.List(ctx, c.Cache, opts)
+		if err != nil {
+			res.Duration = time.Since(start)
+			return res, err
+		}
+		var expired []string
+		var size int64
+		for _, entry := range page.Entries {
+			res.Scanned++
+			maxAge := c.MaxAge
+			if c.MaxAgeFor != nil {
+				maxAge = c.MaxAgeFor(entry.Key)
+			}
+			if maxAge <= 0 || entry.UpdatedAt.IsZero() || !entry.UpdatedAt.Before(start.Add(-maxAge)) {
+				continue
+			}
+			expired = append(expired, entry.Key)
+			size += entry.Size
+		}
+		if len(expired) > 0 && !c.DryRun {
+			if err := cache.DeleteMany(ctx, c.Cache, expired); err != nil {
+				res.Duration = time.Since(start)
+				return res, err
+			}
+		}
+		res.Deleted += int64(len(expired))
+		res.BytesReclaimed += size
+
+		if page.Cursor == "" {
+			break
+		}
+		opts.Cursor = page.Cursor
+	}
+	res.Duration = time.Since(start)
+	return res, nil
+}
+
+// RunExclusive runs the collector unless another replica holds the GC lock.
+func (c *Collector) RunExclusive(ctx context.Context) (Result, error) {
+	l, ok, err := c.Locks.TryLock(ctx, runLockKey, runLockTTL)
+	if err != nil {
+		return Result{}, err
+	}
+	if !ok {
+		return Result{}, ErrLocked
+	}
+	defer l.Unlock(context.Background())
+	defer lock.KeepAlive(ctx, l, runLockTTL)()
+	return c.Run(ctx)
+}
+
+// Loop runs the collector at most once per interval across all replicas until
+// ctx is done. Every replica checks regularly, so collection carries on when
+// the replica that ran it last goes away.
+func (c *Collector) Loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(min(interval, maxCheckEvery))
+	defer ticker.Stop()
+	for {
+		c.runScheduled(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) runScheduled(ctx context.Context, interval time.Duration) {
+	l, ok, err := c.Locks.TryLock(ctx, runLockKey, runLockTTL)
+	if err != nil || !ok {
+		return
+	}
+	defer l.Unlock(context.Background())
+	defer lock.KeepAlive(ctx, l, runLockTTL)()
+
+	// The marker outlives the run lock and records that a run happened
+	// within the last interval.
+	marker, ok, err := c.Locks.TryLock(ctx, lastRunKey, interval)
+	if err != nil || !ok {
+		return
+	}
+
+	res, err := c.Run(ctx)
+	if err != nil {
+		log.Printf("gc: %v (scanned=%d deleted=%d)", err, res.Scanned, res.Deleted)
+		// Let the next check retry instead of waiting a whole interval.
+		_ = marker.Unlock(context.Background())
+		return
+	}
+	log.Printf("gc: scanned=%d deleted=%d reclaimed=%d bytes in %s",
+		res.Scanned, res.Deleted, res.BytesReclaimed, res.Duration.Round(time.Millisecond))
+}
@@ -0,0 +1,71 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/lock"
+)
+
+func putAged(t *testing.T, store cache.Store, key string, age time.Duration) {
+	t.Helper()
+	err := store.Put(context.Background(), key, cache.Object{
+		Body:      io.NopCloser(strings.NewReader("page")),
+		Size:      4,
+		UpdatedAt: time.Now().Add(-age),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunDeletesExpired(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryStore()
+	putAged(t, store, "v1/page/zh/Old", 48*time.Hour)
+	putAged(t, store, "v1/page/zh/New", time.Hour)
+
+	c := &Collector{Cache: store, Locks: lock.NewLocalLocker(), MaxAge: 24 * time.Hour}
+	c.DryRun = true
+	res, err := c.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 2 || res.Deleted != 1 || res.BytesReclaimed != 4 {
+		t.Errorf("dry run result = %+v", res)
+	}
+	if _, err := store.Head(ctx, "v1/page/zh/Old"); err != nil {
+		t.Error("dry run deleted an object")
+	}
+
+	c.DryRun = false
+	if _, err := c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Head(ctx, "v1/page/zh/Old"); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("expired object kept: %v", err)
+	}
+	if _, err := store.Head(ctx, "v1/page/zh/New"); err != nil {
+		t.Errorf("fresh object deleted: %v", err)
+	}
+}
+
+func TestRunExclusive(t *testing.T) {
+	ctx := context.Background()
+	locker := lock.NewLocalLocker()
+	c := &Collector{Cache: cache.NewMemoryStore(), Locks: locker, MaxAge: time.Hour}
+
+	l, _, _ := locker.TryLock(ctx, runLockKey, time.Minute)
+	if _, err := c.RunExclusive(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("RunExclusive while locked = %v, want ErrLocked", err)
+	}
+	_ = l.Unlock(ctx)
+	if _, err := c.RunExclusive(ctx); err != nil {
+		t.Errorf("RunExclusive = %v", err)
+	}
+}
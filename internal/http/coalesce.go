@@ -0,0 +1,172 @@
+package httpx
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/metrics"
+)
+
+// maxSharedBytes bounds the page or MediaWiki response a request keeps in
+// memory to hand to the requests coalesced with it. Larger ones are not
+// shared.
+const maxSharedBytes = 8 << 20
+
+// flights coalesces concurrent requests for the same cache key within the
+// process: the first one looks the page up, taking the distributed lock and
+// filling it if needed, while the others wait for what it found. The leader
+// lands its flight as soon as it has the page, before writing it to its own
+// client, so that a slow client does not hold up the others.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+type flight struct {
+	flights *flights
+	key     string
+	once    sync.Once
+	done    chan struct{}
+	// waiting counts the followers; it is guarded by flights.mu.
+	waiting int
+	// res is nil when the followers have to serve themselves.
+	res *sharedResponse
+}
+
+// sharedResponse is what the leader of a flight found: a page with its stored
+// body, or a non-200 MediaWiki response when status is set.
+type sharedResponse struct {
+	obj         cache.Object
+	cacheStatus string
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// join returns the flight for key and whether the caller leads it. The
+// leader must land the flight once it knows what to serve.
+func (f *flights) join(key string) (*flight, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl, ok := f.m[key]; ok {
+		fl.waiting++
+		return fl, false
+	}
+	if f.m == nil {
+		f.m = make(map[string]*flight)
+	}
+	fl := &flight{flights: f, key: key, done: make(chan struct{})}
+	f.m[key] = fl
+	return fl, true
+}
+
+// land hands res to the followers of fl, or tells them to serve themselves
+// when res is nil. Only the first call counts, and a nil fl, which the
+// handler passes around when a request is not leading a flight, is ignored.
+func (fl *flight) land(res *sharedResponse) {
+	if fl == nil {
+		return
+	}
+	fl.once.Do(func() {
+		fl.flights.mu.Lock()
+		delete(fl.flights.m, fl.key)
+		fl.flights.mu.Unlock()
+		fl.res = res
+		close(fl.done)
+	})
+}
+
+// waited reports whether other requests wait for fl, so that its leader only
+// holds a page in memory when someone needs it.
+func (fl *flight) waited() bool {
+	if fl == nil {
+		return false
+	}
+	fl.flights.mu.Lock()
+	defer fl.flights.mu.Unlock()
+	return fl.waiting > 0
+}
+
+// coalesce serves r from what the leader of fl found, waiting up to maxWait
+// for it. It returns false when there is nothing to share with r, and the
+// caller must serve it itself. Pages are written to r like any other, so its
+// own validators and content coding apply.
+func (h *Handler) coalesce(w http.ResponseWriter, r *http.Request, fl *flight, maxWait time.Duration) bool {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-fl.done:
+	case <-r.Context().Done():
+		return true
+	case <-timer.C:
+		metrics.CoalescedRequests.WithLabelValues("timeout").Inc()
+		return false
+	}
+
+	res := fl.res
+	if res == nil {
+		metrics.CoalescedRequests.WithLabelValues("unshared").Inc()
+		return false
+	}
+	metrics.CoalescedRequests.WithLabelValues("shared").Inc()
+	if res.status != 0 {
+		writeUpstream(w, r, res.status, res.header, bytes.NewReader(res.body))
+		return true
+	}
+	obj := res.obj
+	obj.Body = io.NopCloser(bytes.NewReader(res.body))
+	writeObject(w, r, obj, res.cacheStatus)
+	return true
+}
+
+// writeShared writes obj like writeObject, first handing it to the followers
+// of fl. Its body is read into memory for them when it is small enough;
+// otherwise they serve themselves.
+func writeShared(w http.ResponseWriter, r *http.Request, fl *flight, obj cache.Object, cacheStatus string) {
+	if !fl.waited() || obj.Size < 0 || obj.Size > maxSharedBytes {
+		fl.land(nil)
+		writeObject(w, r, obj, cacheStatus)
+		return
+	}
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		fl.land(nil)
+		obj.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), errorReader{err}))
+		writeObject(w, r, obj, cacheStatus)
+		return
+	}
+	res := &sharedResponse{obj: obj, cacheStatus: cacheStatus, body: data}
+	res.obj.Body = nil
+	fl.land(res)
+	obj.Body = io.NopCloser(bytes.NewReader(data))
+	writeObject(w, r, obj, cacheStatus)
+}
+
+// shareBuffer keeps a copy of up to limit bytes written to it, and none once
+// more was written.
+type shareBuffer struct {
+	limit int
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (b *shareBuffer) Write(p []byte) (int, error) {
+	if !b.over {
+		if b.buf.Len()+len(p) > b.limit {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// errorReader fails every read with err.
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,73 @@
+package httpx
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+)
+
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when no entity
+// tags were sent, against obj.
+func notModified(r *http.Request, obj cache.Object) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return obj.ETag != "" && etagMatches(inm, obj.ETag)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || obj.UpdatedAt.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !obj.UpdatedAt.Truncate(time.Second).After(t)
+}
+
+// etagMatches uses the weak comparison required for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if strings.Trim(candidate, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setValidators sets ETag and Last-Modified for obj. Transcoded bodies differ
+// byte-wise from the stored one, so they only get a weak ETag.
+func setValidators(h http.Header, obj cache.Object, weak bool) {
+	if obj.ETag != "" {
+		etag := `"` + obj.ETag + `"`
+		if weak {
+			etag = "W/" + etag
+		}
+		h.Set("ETag", etag)
+	}
+	if !obj.UpdatedAt.IsZero() {
+		h.Set("Last-Modified", obj.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeNotModified answers r with 304 Not Modified if its validators match obj.
+func writeNotModified(w http.ResponseWriter, r *http.Request, obj cache.Object, cacheStatus string) bool {
+	if !notModified(r, obj) {
+		return false
+	}
+	_, transcoded := clientEncoding(r, obj)
+	setValidators(w.Header(), obj, transcoded)
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("X-Inazuma-Cache", cacheStatus)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,96 @@
+package httpx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/compress"
+	"github.com/52poke/inazuma/internal/mw"
+	"github.com/52poke/inazuma/internal/ttl"
+)
+
+// Fill is a page being fetched from MediaWiki into the cache. Handler fills
+// misses and refreshes with it and the purge handler refreshes purged pages,
+// so that every stored copy gets the same encoding, headers and metadata.
+type Fill struct {
+	// Resp is the MediaWiki response; the caller must close its body.
+	Resp *http.Response
+	// Encoding is the content coding the page is stored in: the storage
+	// encoding, or MediaWiki's when that cannot be transcoded.
+	Encoding string
+
+	upstreamEnc string
+	start       time.Time
+}
+
+// FetchFill requests path from MediaWiki, asking for the storage encoding.
+func FetchFill(ctx context.Context, fetcher mw.Fetcher, path, encoding string) (*Fill, error) {
+	start := time.Now()
+	resp, err := fetcher.Fetch(ctx, path, "", http.Header{"Accept-Encoding": {encoding}})
+	if err != nil {
+		return nil, err
+	}
+	f := &Fill{
+		Resp:        resp,
+		Encoding:    compress.Normalize(encoding),
+		upstreamEnc: compress.Normalize(resp.Header.Get("Content-Encoding")),
+		start:       start,
+	}
+	if !compress.Supported(f.upstreamEnc) {
+		// Nothing we can transcode; keep MediaWiki's encoding as is.
+		f.Encoding = f.upstreamEnc
+	}
+	return f, nil
+}
+
+// Object returns the cache object for a 200 response, with body the response
+// body in f.Encoding. headers is the allowlist of upstream headers kept and
+// pageTTL is recorded with the page.
+func (f *Fill) Object(body io.ReadCloser, headers []string, pageTTL time.Duration) cache.Object {
+	// The fill time covers the whole body, not just MediaWiki's headers.
+	timer := &fillTimer{ReadCloser: body, start: f.start}
+	obj := cache.Object{
+		Body:        timer,
+		Size:        -1,
+		ContentType: f.Resp.Header.Get("Content-Type"),
+		Encoding:    f.Encoding,
+		UpdatedAt:   time.Now().UTC(),
+		Header:      cache.CaptureHeaders(f.Resp.Header, headers),
+		Meta:        map[string]string{ttl.MetaKey: ttl.FormatMeta(pageTTL)},
+		MetaAfterBody: func() map[string]string {
+			return map[string]string{ttl.FillMetaKey: ttl.FormatFill(timer.took)}
+		},
+	}
+	if f.upstreamEnc == f.Encoding {
+		obj.Size = f.Resp.ContentLength
+	}
+	return obj
+}
+
+// Store writes a 200 response to store under key.
+func (f *Fill) Store(ctx context.Context, store cache.Store, key string, headers []string, pageTTL time.Duration) error {
+	body, err := compress.TranscodeReader(f.Resp.Body, f.upstreamEnc, f.Encoding)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return store.Put(ctx, key, f.Object(body, headers, pageTTL))
+}
+
+// fillTimer records how long the fill took once its body reaches EOF.
+type fillTimer struct {
+	io.ReadCloser
+	start time.Time
+	took  time.Duration
+}
+
+func (t *fillTimer) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.EOF && t.took == 0 {
+		t.took = time.Since(t.start)
+	}
+	return n, err
+}
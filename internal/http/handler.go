@@ -1,49 +1,62 @@
 package httpx
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/compress"
 	"github.com/52poke/inazuma/internal/config"
 	"github.com/52poke/inazuma/internal/lock"
 	"github.com/52poke/inazuma/internal/mw"
-	"github.com/redis/go-redis/v9"
+	"github.com/52poke/inazuma/internal/ttl"
 )
 
 type Handler struct {
 	Cfg   config.Config
 	Cache cache.Store
-	MW    *mw.Client
-	Redis *redis.Client
+	MW    mw.Fetcher
+	Locks lock.Locker
 	Proxy *httputil.ReverseProxy
-}
+	// TTL overrides Cfg.CacheTTLSeconds per page when set.
+	TTL *ttl.Rules
+	// Fills, when set, wakes up requests waiting for another request's fill
+	// instead of having them poll the cache.
+	Fills lock.Notifier
+	// Refreshes bounds the expired pages refreshed at the same time to
+	// Cfg.RefreshConcurrency. NewHandler sets an in-process semaphore.
+	Refreshes lock.Semaphore
 
-type upstreamResponse struct {
-	status int
-	header http.Header
-	body   []byte
+	flights flights
 }
 
-const globalRefreshLockKey = "lock:global-refresh"
+const (
+	pollInterval         = 50 * time.Millisecond
+	fallbackPollInterval = 500 * time.Millisecond
+)
 
-func NewHandler(cfg config.Config, store cache.Store, mwClient *mw.Client, redisClient *redis.Client) (*Handler, error) {
+func NewHandler(cfg config.Config, store cache.Store, fetcher mw.Fetcher, locker lock.Locker) (*Handler, error) {
 	u, err := url.Parse(cfg.MediaWikiBaseURL)
 	if err != nil {
 		return nil, err
 	}
 	proxy := httputil.NewSingleHostReverseProxy(u)
 	return &Handler{
-		Cfg:   cfg,
-		Cache: store,
-		MW:    mwClient,
-		Redis: redisClient,
-		Proxy: proxy,
+		Cfg:       cfg,
+		Cache:     store,
+		MW:        fetcher,
+		Locks:     locker,
+		Proxy:     proxy,
+		Refreshes: lock.NewLocalSemaphore(),
 	}, nil
 }
 
@@ -60,35 +73,56 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	key := cache.PageKey(info.Variant, info.Title)
-	obj, err := h.Cache.Get(r.Context(), key)
+	if isConditional(r) {
+		// Answer revalidations from metadata alone when possible.
+		meta, err := h.Cache.Head(r.Context(), key)
+		if err == nil && !h.isExpired(meta, key, info) && writeNotModified(w, r, meta, "HIT") {
+			return
+		}
+	}
+
+	fl, leader := h.flights.join(key)
+	if !leader {
+		if h.coalesce(w, r, fl, time.Duration(h.Cfg.MaxLockWaitSeconds)*time.Second) {
+			return
+		}
+		fl = nil
+	} else {
+		// Unless the page was shared, the followers serve themselves.
+		defer fl.land(nil)
+	}
+	h.servePage(w, r, fl, key, info)
+}
+
+// servePage serves a cacheable page from the cache, filling or refreshing it
+// as needed. A non-nil fl is led by the request and landed before anything is
+// written to w; proxied responses are not shared.
+func (h *Handler) servePage(w http.ResponseWriter, r *http.Request, fl *flight, key string, info RequestInfo) {
+	obj, err := h.load(r.Context(), key)
 	if err == nil {
-		if !isExpired(obj.UpdatedAt, h.Cfg.CacheTTLSeconds) {
-			writeObject(w, obj, "HIT")
+		defer obj.Body.Close()
+		if !h.isExpired(obj, key, info) {
+			writeShared(w, r, fl, obj, "HIT")
 			return
 		}
-		if h.tryRefreshExpired(w, r, key, info) {
+		if h.tryRefreshExpired(w, r, fl, key, info) {
 			return
 		}
-		writeObject(w, obj, "STALE")
+		writeShared(w, r, fl, obj, "STALE")
 		return
 	}
 	if !errors.Is(err, cache.ErrNotFound) {
+		fl.land(nil)
 		h.Proxy.ServeHTTP(w, r)
 		return
 	}
 
-	obj, ok, upstream := h.getWithLock(r.Context(), key, info)
-	if ok {
-		writeObject(w, obj, "MISS")
-		return
-	}
-
-	if upstream != nil {
-		writeUpstream(w, upstream)
+	if h.getWithLock(w, r, fl, key, info) {
 		return
 	}
 
 	// fallback to MediaWiki
+	fl.land(nil)
 	h.Proxy.ServeHTTP(w, r)
 }
 
@@ -104,108 +138,254 @@ func (h *Handler) isLoggedIn(r *http.Request) bool {
 	return cookie.Value != ""
 }
 
-func (h *Handler) getWithLock(ctx context.Context, key string, info RequestInfo) (cache.Object, bool, *upstreamResponse) {
+// getWithLock serves a cache miss, filling the cache from MediaWiki unless
+// another request already holds the fill lock. It returns false when nothing
+// has been written to w.
+func (h *Handler) getWithLock(w http.ResponseWriter, r *http.Request, fl *flight, key string, info RequestInfo) bool {
+	ctx := r.Context()
 	lockKey := "lock:" + key
 	lockTTL := time.Duration(h.Cfg.LockTTLSeconds) * time.Second
 	maxWait := time.Duration(h.Cfg.MaxLockWaitSeconds) * time.Second
 	deadline := time.Now().Add(maxWait)
 
+	// Waiters are woken up when the fill finishes and only poll as a
+	// fallback for lost notifications.
+	var filled <-chan struct{}
+	poll := pollInterval
+	if h.Fills != nil {
+		if sub, err := h.Fills.Subscribe(ctx, key); err == nil {
+			defer sub.Close()
+			filled, poll = sub.C, fallbackPollInterval
+		}
+	}
+
 	for {
-		l, ok, err := lock.TryLock(ctx, h.Redis, lockKey, lockTTL)
+		l, ok, err := h.Locks.TryLock(ctx, lockKey, lockTTL)
 		if err != nil {
-			return cache.Object{}, false, nil
+			return false
 		}
 		if ok {
-			defer l.Unlock(ctx)
-			obj, err := h.Cache.Get(ctx, key)
+			release := h.holdFill(ctx, key, l, lockTTL)
+			defer release()
+			obj, err := h.load(ctx, key)
 			if err == nil {
-				return obj, true, nil
+				defer obj.Body.Close()
+				writeShared(w, r, fl, obj, "MISS")
+				return true
 			}
-			obj, upstream, err := h.fetchAndStore(ctx, info, key)
-			if err != nil {
-				return cache.Object{}, false, nil
-			}
-			if upstream != nil {
-				return cache.Object{}, false, upstream
-			}
-			return obj, true, nil
+			status, _ := h.fill(w, r, fl, info, key, "MISS", release)
+			return status != 0
 		}
 
-		obj, err := h.Cache.Get(ctx, key)
+		obj, err := h.load(ctx, key)
 		if err == nil {
-			return obj, true, nil
+			defer obj.Body.Close()
+			writeShared(w, r, fl, obj, "MISS")
+			return true
 		}
 
 		if time.Now().After(deadline) {
-			return cache.Object{}, false, nil
+			return false
 		}
 		select {
 		case <-ctx.Done():
-			return cache.Object{}, false, nil
-		case <-time.After(50 * time.Millisecond):
+			return false
+		case <-filled:
+		case <-time.After(poll):
 		}
 	}
 }
 
-func (h *Handler) tryRefreshExpired(w http.ResponseWriter, r *http.Request, key string, info RequestInfo) bool {
+// holdFill keeps the fill lock l of key alive and returns a function that
+// stops doing so, releases l and wakes up the requests waiting in getWithLock.
+// fill calls it as soon as the page is stored; later calls do nothing.
+func (h *Handler) holdFill(ctx context.Context, key string, l lock.Lock, ttl time.Duration) (release func()) {
+	stop := lock.KeepAlive(ctx, l, ttl)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stop()
+			_ = l.Unlock(ctx)
+			h.notifyFilled(ctx, key)
+		})
+	}
+}
+
+// notifyFilled wakes up the requests waiting in getWithLock for key. It runs
+// once the fill lock is released, so a waiter finds either the page or a free
+// lock.
+func (h *Handler) notifyFilled(ctx context.Context, key string) {
+	if h.Fills != nil {
+		_ = h.Fills.Notify(ctx, key)
+	}
+}
+
+func (h *Handler) tryRefreshExpired(w http.ResponseWriter, r *http.Request, fl *flight, key string, info RequestInfo) bool {
 	lockTTL := time.Duration(h.Cfg.LockTTLSeconds) * time.Second
-	globalLock, ok, err := lock.TryLock(r.Context(), h.Redis, globalRefreshLockKey, lockTTL)
+	perKey, ok, err := h.Locks.TryLock(r.Context(), "lock:"+key, lockTTL)
 	if err != nil || !ok {
 		return false
 	}
-	defer globalLock.Unlock(r.Context())
+	releaseLock := h.holdFill(r.Context(), key, perKey, lockTTL)
+	defer releaseLock()
 
-	perKey, ok, err := lock.TryLock(r.Context(), h.Redis, "lock:"+key, lockTTL)
-	if err != nil || !ok {
+	permit, ok := h.acquireRefreshPermit(r.Context(), lockTTL)
+	if !ok {
 		return false
 	}
-	defer perKey.Unlock(r.Context())
+	stopPermit := lock.KeepAlive(r.Context(), permit, lockTTL)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			stopPermit()
+			h.releaseRefreshPermit(r.Context(), permit)
+			releaseLock()
+		})
+	}
+	defer release()
 
-	current, err := h.Cache.Get(r.Context(), key)
-	if err == nil && !isExpired(current.UpdatedAt, h.Cfg.CacheTTLSeconds) {
-		writeObject(w, current, "HIT")
-		return true
+	current, err := h.load(r.Context(), key)
+	if err == nil {
+		defer current.Body.Close()
+		if !h.isExpired(current, key, info) {
+			writeShared(w, r, fl, current, "HIT")
+			return true
+		}
 	}
 
-	fresh, upstream, err := h.fetchAndStore(r.Context(), info, key)
-	if err != nil {
+	status, _ := h.fill(w, r, fl, info, key, "REFRESH", release)
+	if status == 0 {
 		return false
 	}
-	if upstream != nil {
-		if upstream.status < http.StatusInternalServerError {
-			_ = h.Cache.Delete(r.Context(), key)
-		}
-		writeUpstream(w, upstream)
-		return true
+	if status != http.StatusOK && status < http.StatusInternalServerError {
+		_ = h.Cache.Delete(r.Context(), key)
 	}
-	writeObject(w, fresh, "REFRESH")
 	return true
 }
 
-func (h *Handler) fetchAndStore(ctx context.Context, info RequestInfo, key string) (cache.Object, *upstreamResponse, error) {
-	path := buildVariantPath(info)
-	resp, body, err := h.MW.Fetch(ctx, path, "", http.Header{})
+// fill fetches the page from MediaWiki and streams it to the client and to the
+// cache at the same time, the client from a spool so that it may fall behind
+// without slowing the cache write. The cache copy is stored as described by
+// Fill and only committed if the upstream body was read completely. Once the
+// store is done, stored is called and fl is landed with the stored page, so
+// that neither the fill lock nor the followers wait for the client. fill
+// returns the upstream status, or 0 when nothing has been written to w.
+func (h *Handler) fill(w http.ResponseWriter, r *http.Request, fl *flight, info RequestInfo, key string, cacheStatus string, stored func()) (int, error) {
+	ctx := r.Context()
+	f, err := FetchFill(ctx, h.MW, buildVariantPath(info), h.Cfg.StorageEncoding)
 	if err != nil {
-		return cache.Object{}, nil, err
+		return 0, err
 	}
+	resp := f.Resp
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return cache.Object{}, &upstreamResponse{
-			status: resp.StatusCode,
-			header: resp.Header.Clone(),
-			body:   body,
-		}, nil
+		body := io.Reader(resp.Body)
+		if fl.waited() {
+			data, err := io.ReadAll(io.LimitReader(resp.Body, maxSharedBytes+1))
+			if err != nil {
+				body = io.MultiReader(bytes.NewReader(data), errorReader{err})
+			} else {
+				body = io.MultiReader(bytes.NewReader(data), resp.Body)
+				if len(data) <= maxSharedBytes {
+					fl.land(&sharedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: data})
+				}
+			}
+		}
+		fl.land(nil)
+		writeUpstream(w, r, resp.StatusCode, resp.Header, body)
+		return resp.StatusCode, nil
+	}
+
+	upstreamEnc, storeEnc := f.upstreamEnc, f.Encoding
+	clientEnc := compress.Negotiate(r.Header.Get("Accept-Encoding"), storeEnc)
+	if !compress.Supported(upstreamEnc) {
+		clientEnc = upstreamEnc
 	}
 
-	obj := cache.Object{
-		Body:        body,
-		ContentType: resp.Header.Get("Content-Type"),
-		Encoding:    resp.Header.Get("Content-Encoding"),
-		UpdatedAt:   time.Now().UTC(),
+	pr, pw := io.Pipe()
+	obj := f.Object(pr, h.Cfg.CacheHeaders, h.pageTTL(info))
+	// The stored body is kept for the followers, who may arrive during the
+	// fill.
+	var shared *shareBuffer
+	storeDst := io.Writer(pw)
+	if fl != nil {
+		shared = &shareBuffer{limit: maxSharedBytes}
+		storeDst = io.MultiWriter(pw, shared)
 	}
-	if err := h.Cache.Put(ctx, key, obj); err != nil {
-		return cache.Object{}, nil, err
+	storeW, err := compress.NewTranscoder(storeDst, upstreamEnc, storeEnc)
+	if err != nil {
+		return 0, err
 	}
-	return obj, nil, nil
+	clientW, err := compress.NewTranscoder(w, upstreamEnc, clientEnc)
+	if err != nil {
+		return 0, err
+	}
+
+	putDone := make(chan error, 1)
+	go func() {
+		err := h.Cache.Put(ctx, key, obj)
+		// Unblock the copy below if Put gave up before reading everything.
+		pr.CloseWithError(err)
+		putDone <- err
+	}()
+
+	clientObj := obj
+	clientObj.Encoding = clientEnc
+	clientObj.Size = -1
+	if upstreamEnc == clientEnc {
+		clientObj.Size = resp.ContentLength
+	}
+	setValidators(w.Header(), clientObj, false)
+	writeHeader(w, clientObj, cacheStatus)
+
+	// The client is sent its copy from a spool, so a slow reader neither
+	// holds up the cache write nor stretches the upstream read past the
+	// MediaWiki timeout.
+	spooled := newSpool(maxSpoolMemory)
+	defer spooled.Close()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(clientW, spooled)
+		if err != nil {
+			spooled.Abandon()
+		}
+		if closeErr := clientW.Close(); err == nil {
+			err = closeErr
+		}
+		sent <- err
+	}()
+
+	// A failing client or store must not cut off the other one, so only
+	// upstream read errors stop the copy.
+	store := &bestEffortWriter{w: storeW}
+	client := &bestEffortWriter{w: spooled}
+	_, err = io.Copy(io.MultiWriter(store, client), resp.Body)
+	if err != nil {
+		spooled.CloseWrite(err)
+	} else {
+		spooled.CloseWrite(client.err)
+	}
+	if err == nil {
+		err = store.err
+	}
+	if err == nil {
+		err = storeW.Close()
+	}
+	pw.CloseWithError(err)
+	if putErr := <-putDone; err == nil {
+		err = putErr
+	}
+	stored()
+	if err == nil && shared != nil && !shared.over {
+		res := &sharedResponse{obj: obj, cacheStatus: cacheStatus, body: shared.buf.Bytes()}
+		res.obj.Body = nil
+		res.obj.MetaAfterBody = nil
+		res.obj.Size = int64(len(res.body))
+		fl.land(res)
+	}
+	fl.land(nil)
+	<-sent
+	return http.StatusOK, err
 }
 
 func buildVariantPath(info RequestInfo) string {
@@ -219,35 +399,117 @@ func buildVariantPath(info RequestInfo) string {
 	}
 }
 
-func writeObject(w http.ResponseWriter, obj cache.Object, cacheStatus string) {
+// writeObject writes obj in the client's preferred content coding,
+// transcoding the stored body when the client does not accept its encoding.
+func writeObject(w http.ResponseWriter, r *http.Request, obj cache.Object, cacheStatus string) {
+	if writeNotModified(w, r, obj, cacheStatus) {
+		return
+	}
+	clientEnc, transcoded := clientEncoding(r, obj)
+	setValidators(w.Header(), obj, transcoded)
+	if !transcoded {
+		writeHeader(w, obj, cacheStatus)
+		_, _ = io.Copy(w, obj.Body)
+		return
+	}
+
+	body, err := compress.TranscodeReader(obj.Body, obj.Encoding, clientEnc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	obj.Encoding = clientEnc
+	obj.Size = -1
+	writeHeader(w, obj, cacheStatus)
+	_, _ = io.Copy(w, body)
+}
+
+// clientEncoding returns the content coding obj is served in for r and
+// whether that requires transcoding the stored body.
+func clientEncoding(r *http.Request, obj cache.Object) (string, bool) {
+	enc := compress.Normalize(obj.Encoding)
+	if !compress.Supported(enc) {
+		return enc, false
+	}
+	clientEnc := compress.Negotiate(r.Header.Get("Accept-Encoding"), enc)
+	return clientEnc, clientEnc != enc
+}
+
+func writeHeader(w http.ResponseWriter, obj cache.Object, cacheStatus string) {
+	for k, vv := range obj.Header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
 	if obj.ContentType != "" {
 		w.Header().Set("Content-Type", obj.ContentType)
 	}
-	if obj.Encoding != "" {
-		w.Header().Set("Content-Encoding", obj.Encoding)
+	if enc := compress.Normalize(obj.Encoding); enc != compress.Identity {
+		w.Header().Set("Content-Encoding", enc)
+	}
+	if obj.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
 	}
+	w.Header().Add("Vary", "Accept-Encoding")
 	w.Header().Set("X-Inazuma-Cache", cacheStatus)
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(obj.Body)
 }
 
-func writeUpstream(w http.ResponseWriter, upstream *upstreamResponse) {
-	for k, vv := range upstream.header {
+// writeUpstream relays a non-200 MediaWiki response, decoding it when the
+// client does not accept the encoding MediaWiki chose.
+func writeUpstream(w http.ResponseWriter, r *http.Request, status int, header http.Header, body io.Reader) {
+	for k, vv := range header {
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
-	w.WriteHeader(upstream.status)
-	_, _ = w.Write(upstream.body)
+	enc := compress.Normalize(header.Get("Content-Encoding"))
+	if clientEnc := compress.Negotiate(r.Header.Get("Accept-Encoding"), enc); compress.Supported(enc) && clientEnc != enc {
+		decoded, err := compress.TranscodeReader(body, enc, clientEnc)
+		if err == nil {
+			defer decoded.Close()
+			body = decoded
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Encoding")
+			if clientEnc != compress.Identity {
+				w.Header().Set("Content-Encoding", clientEnc)
+			}
+		}
+	}
+	w.WriteHeader(status)
+	_, _ = io.Copy(w, body)
+}
+
+// bestEffortWriter drops writes after the first error instead of failing, so
+// it can sit next to other writers in an io.MultiWriter.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (b *bestEffortWriter) Write(p []byte) (int, error) {
+	if b.err == nil {
+		_, b.err = b.w.Write(p)
+	}
+	return len(p), nil
 }
 
-func isExpired(updatedAt time.Time, ttlSeconds int) bool {
-	if updatedAt.IsZero() {
+// isExpired applies the page TTL shortened by the per-key jitter, and may
+// report a page close to expiry as expired early; see ttl.RefreshEarly.
+func (h *Handler) isExpired(obj cache.Object, key string, info RequestInfo) bool {
+	d := ttl.Jitter(h.pageTTL(info), key, float64(h.Cfg.ExpiryJitterPercent)/100)
+	if ttl.Expired(obj.UpdatedAt, d) {
 		return true
 	}
-	if ttlSeconds <= 0 {
+	if d <= 0 {
 		return false
 	}
-	ttl := time.Duration(ttlSeconds) * time.Second
-	return updatedAt.Add(ttl).Before(time.Now())
+	return ttl.RefreshEarly(obj.UpdatedAt.Add(d), ttl.ParseFill(obj.Meta), h.Cfg.EarlyRefreshBeta)
+}
+
+// pageTTL returns the TTL of the requested page under the current rules.
+func (h *Handler) pageTTL(info RequestInfo) time.Duration {
+	if h.TTL != nil {
+		return h.TTL.TTL(info.Variant, info.Title)
+	}
+	return time.Duration(h.Cfg.CacheTTLSeconds) * time.Second
 }
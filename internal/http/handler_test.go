@@ -0,0 +1,733 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/config"
+	"github.com/52poke/inazuma/internal/lock"
+	"github.com/52poke/inazuma/internal/mw/mwtest"
+	"github.com/52poke/inazuma/internal/ttl"
+)
+
+const testPage = "<p>皮卡丘</p>"
+
+type testEnv struct {
+	h       *Handler
+	store   cache.Store
+	fetcher *mwtest.Fetcher
+	proxied int
+}
+
+func newTestEnv(t *testing.T, store cache.Store) *testEnv {
+	t.Helper()
+	env := &testEnv{store: store, fetcher: mwtest.NewFetcher()}
+	env.fetcher.Set("/zh/Pikachu", mwtest.Page{
+		Header: http.Header{"Content-Type": {"text/html; charset=UTF-8"}},
+		Body:   testPage,
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.proxied++
+		io.WriteString(w, "proxied")
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := config.Config{
+		MediaWikiBaseURL:   upstream.URL,
+		LoggedInCookieName: "wikiUserID",
+		CacheTTLSeconds:    3600,
+		LockTTLSeconds:     10,
+		MaxLockWaitSeconds: 1,
+		StorageEncoding:    "gzip",
+		VerifyMaxBytes:     1 << 20,
+	}
+	h, err := NewHandler(cfg, store, env.fetcher, lock.NewLocalLocker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.h = h
+	return env
+}
+
+func (env *testEnv) do(path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	env.h.ServeHTTP(rec, req)
+	return rec
+}
+
+func checkResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, cacheStatus, body string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d", rec.Code, status)
+	}
+	if got := rec.Header().Get("X-Inazuma-Cache"); got != cacheStatus {
+		t.Errorf("X-Inazuma-Cache = %q, want %q", got, cacheStatus)
+	}
+	if got := rec.Body.String(); got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestMissThenHit(t *testing.T) {
+	env := newTestEnv(t, cache.NewMemoryStore())
+
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "MISS", testPage)
+	rec := env.do("/zh/Pikachu", nil)
+	checkResponse(t, rec, http.StatusOK, "HIT", testPage)
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if calls := env.fetcher.Calls(); len(calls) != 1 {
+		t.Errorf("fetched %v, want a single fetch", calls)
+	}
+
+	obj, err := env.store.Head(context.Background(), cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Encoding != "gzip" {
+		t.Errorf("stored encoding = %q, want gzip", obj.Encoding)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	env := newTestEnv(t, cache.NewMemoryStore())
+	env.do("/zh/Pikachu", nil)
+	etag := env.do("/zh/Pikachu", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on a cached page")
+	}
+
+	rec := env.do("/zh/Pikachu", http.Header{"If-None-Match": {etag}})
+	checkResponse(t, rec, http.StatusNotModified, "HIT", "")
+}
+
+func TestUpstreamErrorIsNotCached(t *testing.T) {
+	env := newTestEnv(t, cache.NewMemoryStore())
+
+	rec := env.do("/zh/Missingno", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	env.do("/zh/Missingno", nil)
+	if calls := env.fetcher.Calls(); len(calls) != 2 {
+		t.Errorf("fetched %v, want two fetches", calls)
+	}
+}
+
+func TestExpiredPageIsRefreshed(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	err := store.Put(context.Background(), cache.PageKey("zh", "Pikachu"), cache.Object{
+		Body:      io.NopCloser(strings.NewReader("old")),
+		Size:      3,
+		UpdatedAt: time.Now().Add(-2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "REFRESH", testPage)
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "HIT", testPage)
+}
+
+func TestLoggedInIsProxied(t *testing.T) {
+	env := newTestEnv(t, cache.NewMemoryStore())
+	rec := env.do("/zh/Pikachu", http.Header{"Cookie": {"wikiUserID=1"}})
+	if rec.Body.String() != "proxied" || env.proxied != 1 {
+		t.Errorf("logged-in request was not proxied: %q", rec.Body.String())
+	}
+	if len(env.fetcher.Calls()) != 0 {
+		t.Error("logged-in request filled the cache")
+	}
+}
+
+// brokenStore fails every read like an unreachable bucket.
+type brokenStore struct{ cache.Store }
+
+func (brokenStore) Get(ctx context.Context, key string) (cache.Object, error) {
+	return cache.Object{}, fmt.Errorf("connection refused")
+}
+
+func TestStoreErrorIsProxied(t *testing.T) {
+	env := newTestEnv(t, brokenStore{cache.NewMemoryStore()})
+	rec := env.do("/zh/Pikachu", nil)
+	if rec.Body.String() != "proxied" || env.proxied != 1 {
+		t.Errorf("request was not proxied: %q", rec.Body.String())
+	}
+}
+
+// corruptingStore makes the next body read fail its checksum.
+type corruptingStore struct {
+	cache.Store
+	corrupt bool
+}
+
+func (s *corruptingStore) Get(ctx context.Context, key string) (cache.Object, error) {
+	obj, err := s.Store.Get(ctx, key)
+	if err != nil || !s.corrupt {
+		return obj, err
+	}
+	s.corrupt = false
+	obj.Body = io.NopCloser(io.MultiReader(obj.Body, errorReader{cache.ErrCorrupted}))
+	return obj, nil
+}
+
+func TestCorruptedPageIsRefilled(t *testing.T) {
+	store := &corruptingStore{Store: cache.NewMemoryStore()}
+	env := newTestEnv(t, store)
+	env.do("/zh/Pikachu", nil)
+
+	store.corrupt = true
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "MISS", testPage)
+	if calls := env.fetcher.Calls(); len(calls) != 2 {
+		t.Errorf("fetched %v, want a refill", calls)
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "HIT", testPage)
+}
+
+func TestTamperedDataKeyIsRefilled(t *testing.T) {
+	ctx := context.Background()
+	backend := cache.NewMemoryStore()
+	store, err := cache.NewEncryptedStore(backend, []string{"k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, store)
+	env.do("/zh/Pikachu", nil)
+
+	key := cache.PageKey("zh", "Pikachu")
+	raw, err := backend.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Body.Close()
+	raw.Meta["enc_dek"] = "not base64!"
+	if err := backend.Put(ctx, key, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "MISS", testPage)
+	if calls := env.fetcher.Calls(); len(calls) != 2 {
+		t.Errorf("fetched %v, want a refill", calls)
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "HIT", testPage)
+}
+
+func TestLargeCorruptedPageIsDiscarded(t *testing.T) {
+	store := &corruptingStore{Store: cache.NewMemoryStore()}
+	env := newTestEnv(t, store)
+	env.h.Cfg.VerifyMaxBytes = 0
+	env.do("/zh/Pikachu", nil)
+
+	// Streamed bodies are only found corrupted at their end, so the object is
+	// dropped for the next request.
+	store.corrupt = true
+	env.do("/zh/Pikachu", nil)
+	if _, err := store.Head(context.Background(), cache.PageKey("zh", "Pikachu")); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Head after a corrupted read = %v, want ErrNotFound", err)
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "MISS", testPage)
+}
+
+func TestTierHitsAreNotVerifiedAgain(t *testing.T) {
+	store := cache.NewTieredStore(cache.NewMemoryStore(), 1<<20, time.Minute, 0)
+	env := newTestEnv(t, store)
+	env.do("/zh/Pikachu", nil)
+	env.do("/zh/Pikachu", nil)
+
+	obj, err := env.h.load(context.Background(), cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+	if _, ok := obj.Body.(*corruptionReader); ok || !obj.Verified {
+		t.Error("a tier hit was verified again")
+	}
+}
+
+func TestTTLRules(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	rules, err := ttl.New([]ttl.Rule{{Title: "Pikachu", TTLSeconds: 60}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.h.TTL = rules
+
+	env.do("/zh/Pikachu", nil)
+	key := cache.PageKey("zh", "Pikachu")
+	obj, err := store.Head(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.Meta[ttl.MetaKey]; got != "60" {
+		t.Errorf("recorded TTL = %q, want 60", got)
+	}
+
+	// Five minutes is past the rule's TTL but within the default.
+	err = store.Put(context.Background(), key, cache.Object{
+		Body:      io.NopCloser(strings.NewReader("old")),
+		Size:      3,
+		UpdatedAt: time.Now().Add(-5 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "REFRESH", testPage)
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	env.h.Cfg.EarlyRefreshBeta = 1e6
+	// Ten minutes before expiry, but rendering took a minute: with this beta
+	// the page is all but certain to be refreshed ahead of time.
+	err := store.Put(context.Background(), cache.PageKey("zh", "Pikachu"), cache.Object{
+		Body:      io.NopCloser(strings.NewReader("old")),
+		Size:      3,
+		UpdatedAt: time.Now().Add(-50 * time.Minute),
+		Meta:      map[string]string{ttl.FillMetaKey: ttl.FormatFill(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "REFRESH", testPage)
+	obj, err := store.Head(context.Background(), cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obj.Meta[ttl.FillMetaKey]; !ok {
+		t.Error("fill time was not recorded")
+	}
+}
+
+// slowBodyFetcher sends headers at once and the body after delay.
+type slowBodyFetcher struct {
+	*mwtest.Fetcher
+	delay time.Duration
+}
+
+func (f slowBodyFetcher) Fetch(ctx context.Context, path string, rawQuery string, headers http.Header) (*http.Response, error) {
+	resp, err := f.Fetcher.Fetch(ctx, path, rawQuery, headers)
+	if err == nil {
+		body := resp.Body
+		resp.Body = readCloser{Reader: io.MultiReader(delayReader(f.delay), body), Closer: body}
+	}
+	return resp, err
+}
+
+type delayReader time.Duration
+
+func (d delayReader) Read([]byte) (int, error) {
+	time.Sleep(time.Duration(d))
+	return 0, io.EOF
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func TestFillTimeCoversBody(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	env.h.MW = slowBodyFetcher{Fetcher: env.fetcher, delay: 50 * time.Millisecond}
+	env.do("/zh/Pikachu", nil)
+
+	obj, err := store.Head(context.Background(), cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fill := ttl.ParseFill(obj.Meta); fill < 50*time.Millisecond {
+		t.Errorf("recorded fill time %v, want it to cover the body", fill)
+	}
+}
+
+func TestWaiterIsNotified(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	env.h.Fills = lock.NewLocalNotifier()
+	key := cache.PageKey("zh", "Pikachu")
+
+	// Another request is filling the page.
+	l, _, _ := env.h.Locks.TryLock(context.Background(), "lock:"+key, time.Minute)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- env.do("/zh/Pikachu", nil) }()
+
+	time.Sleep(20 * time.Millisecond)
+	err := store.Put(context.Background(), key, cache.Object{
+		Body:      io.NopCloser(strings.NewReader("filled")),
+		Size:      6,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Unlock(context.Background())
+	start := time.Now()
+	_ = env.h.Fills.Notify(context.Background(), key)
+
+	checkResponse(t, <-done, http.StatusOK, "MISS", "filled")
+	if waited := time.Since(start); waited >= fallbackPollInterval {
+		t.Errorf("waiter took %v to notice the fill", waited)
+	}
+	if calls := env.fetcher.Calls(); len(calls) != 0 {
+		t.Errorf("waiter fetched %v", calls)
+	}
+}
+
+// gatedStore counts Gets and holds them until release is closed.
+type gatedStore struct {
+	cache.Store
+	release chan struct{}
+	gets    atomic.Int32
+	// noHead fails Heads, so that conditional requests are not answered
+	// before they coalesce.
+	noHead bool
+}
+
+func (s *gatedStore) Get(ctx context.Context, key string) (cache.Object, error) {
+	s.gets.Add(1)
+	<-s.release
+	return s.Store.Get(ctx, key)
+}
+
+func (s *gatedStore) Head(ctx context.Context, key string) (cache.Object, error) {
+	if s.noHead {
+		return cache.Object{}, errors.New("head disabled")
+	}
+	return s.Store.Head(ctx, key)
+}
+
+// waitForGet waits until a request is blocked in s.Get, making it the leader
+// of the requests started after it.
+func (s *gatedStore) waitForGet(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.gets.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no request reached the store")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentRequestsAreCoalesced(t *testing.T) {
+	store := &gatedStore{Store: cache.NewMemoryStore(), release: make(chan struct{})}
+	env := newTestEnv(t, store)
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 20)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = env.do("/zh/Pikachu", nil)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	for _, rec := range recs {
+		checkResponse(t, rec, http.StatusOK, "MISS", testPage)
+	}
+	// The leader checks the cache again once it holds the fill lock.
+	if gets := store.gets.Load(); gets != 2 {
+		t.Errorf("store got %d Gets, want 2", gets)
+	}
+	if calls := env.fetcher.Calls(); len(calls) != 1 {
+		t.Errorf("fetched %v, want a single fetch", calls)
+	}
+}
+
+func TestCoalescedUpstreamError(t *testing.T) {
+	store := &gatedStore{Store: cache.NewMemoryStore(), release: make(chan struct{})}
+	env := newTestEnv(t, store)
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 5)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = env.do("/zh/Missingno", nil)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	for _, rec := range recs {
+		if rec.Code != http.StatusNotFound || rec.Body.String() != "not found" {
+			t.Errorf("response = %d %q", rec.Code, rec.Body.String())
+		}
+	}
+	if calls := env.fetcher.Calls(); len(calls) != 1 {
+		t.Errorf("fetched %v, want a single fetch", calls)
+	}
+}
+
+func TestSlowLeaderDoesNotDelayCoalescedRequests(t *testing.T) {
+	store := &gatedStore{Store: cache.NewMemoryStore(), release: make(chan struct{})}
+	env := newTestEnv(t, store)
+	env.h.Cfg.MaxLockWaitSeconds = 10
+
+	leader := &blockedWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		env.h.ServeHTTP(leader, httptest.NewRequest(http.MethodGet, "/zh/Pikachu", nil))
+	}()
+	store.waitForGet(t)
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 5)
+	for i := range recs {
+		wg.Go(func() { recs[i] = env.do("/zh/Pikachu", nil) })
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+
+	followersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(followersDone)
+	}()
+	select {
+	case <-followersDone:
+	case <-time.After(2 * time.Second):
+		t.Error("coalesced requests waited for the leader's client")
+	}
+	close(leader.release)
+	<-leaderDone
+	<-followersDone
+
+	checkResponse(t, leader.ResponseRecorder, http.StatusOK, "MISS", testPage)
+	for _, rec := range recs {
+		checkResponse(t, rec, http.StatusOK, "MISS", testPage)
+	}
+	if calls := env.fetcher.Calls(); len(calls) != 1 {
+		t.Errorf("fetched %v, want a single fetch", calls)
+	}
+}
+
+func TestCoalescedConditionalRequests(t *testing.T) {
+	ctx := context.Background()
+	mem := cache.NewMemoryStore()
+	err := mem.Put(ctx, cache.PageKey("zh", "Pikachu"), cache.Object{
+		Body:        io.NopCloser(strings.NewReader(testPage)),
+		Size:        int64(len(testPage)),
+		ContentType: "text/html; charset=UTF-8",
+		UpdatedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := mem.Head(ctx, cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &gatedStore{Store: mem, release: make(chan struct{}), noHead: true}
+	env := newTestEnv(t, store)
+
+	var leader, revalidated, plain *httptest.ResponseRecorder
+	var wg sync.WaitGroup
+	wg.Go(func() { leader = env.do("/zh/Pikachu", nil) })
+	store.waitForGet(t)
+	wg.Go(func() {
+		revalidated = env.do("/zh/Pikachu", http.Header{"If-None-Match": {`"` + stored.ETag + `"`}})
+	})
+	wg.Go(func() {
+		plain = env.do("/zh/Pikachu", http.Header{"If-None-Match": {`"other"`}})
+	})
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	checkResponse(t, leader, http.StatusOK, "HIT", testPage)
+	checkResponse(t, revalidated, http.StatusNotModified, "HIT", "")
+	checkResponse(t, plain, http.StatusOK, "HIT", testPage)
+	if gets := store.gets.Load(); gets != 1 {
+		t.Errorf("store got %d Gets, want 1", gets)
+	}
+}
+
+func TestRefreshConcurrency(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	env.h.Cfg.RefreshConcurrency = 2
+	err := store.Put(context.Background(), cache.PageKey("zh", "Pikachu"), cache.Object{
+		Body:      io.NopCloser(strings.NewReader("old")),
+		Size:      3,
+		UpdatedAt: time.Now().Add(-2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other pages are being refreshed and hold every permit.
+	for range 2 {
+		if _, ok, _ := env.h.Refreshes.TryAcquire(context.Background(), refreshPermitKey, 2, time.Minute); !ok {
+			t.Fatal("could not take a refresh permit")
+		}
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "STALE", "old")
+	if calls := env.fetcher.Calls(); len(calls) != 0 {
+		t.Errorf("fetched %v without a permit", calls)
+	}
+}
+
+// blockedWriter holds every body write until release is closed.
+type blockedWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestSlowClientDoesNotDelayFill(t *testing.T) {
+	store := cache.NewMemoryStore()
+	env := newTestEnv(t, store)
+	w := &blockedWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		env.h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/zh/Pikachu", nil))
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := store.Head(context.Background(), cache.PageKey("zh", "Pikachu")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(w.release)
+			t.Fatal("the page was not stored while the client was blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(w.release)
+	<-done
+	checkResponse(t, w.ResponseRecorder, http.StatusOK, "MISS", testPage)
+}
+
+func TestSlowClientDoesNotHoldFillLock(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, cache.NewMemoryStore())
+	env.h.Fills = lock.NewLocalNotifier()
+	key := cache.PageKey("zh", "Pikachu")
+	sub, err := env.h.Fills.Subscribe(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	w := &blockedWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		env.h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/zh/Pikachu", nil))
+	}()
+	defer func() {
+		close(w.release)
+		<-done
+	}()
+
+	select {
+	case <-sub.C:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiters were not notified while the client was blocked")
+	}
+	l, ok, err := env.h.Locks.TryLock(ctx, "lock:"+key, time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("TryLock = %v, %v; want the fill lock released", ok, err)
+	}
+	l.Unlock(ctx)
+}
+
+func TestSpoolOverflowsToFile(t *testing.T) {
+	s := newSpool(4)
+	defer s.Close()
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		if _, err := s.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.CloseWrite(nil)
+	if s.file == nil {
+		t.Error("spool did not overflow to a file")
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdefghi" {
+		t.Errorf("spooled = %q, want %q", got, "abcdefghi")
+	}
+}
+
+func TestCorruptedEncryptedChunkIsRefilled(t *testing.T) {
+	ctx := context.Background()
+	backend := cache.NewMemoryStore()
+	store, err := cache.NewEncryptedStore(backend, []string{"k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, store)
+	// Random text keeps the gzipped page spanning several 64 KiB chunks.
+	rng := rand.New(rand.NewPCG(1, 2))
+	page := make([]byte, 400<<10)
+	for i := range page {
+		page[i] = "0123456789abcdef"[rng.IntN(16)]
+	}
+	env.fetcher.Set("/zh/Pikachu", mwtest.Page{Body: string(page)})
+	env.do("/zh/Pikachu", nil)
+
+	key := cache.PageKey("zh", "Pikachu")
+	raw, err := backend.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(raw.Body)
+	raw.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) < 3<<16 {
+		t.Fatalf("stored body is %d bytes, want several chunks", len(sealed))
+	}
+	sealed[70000] ^= 0xff
+	raw.Body = io.NopCloser(bytes.NewReader(sealed))
+	if err := backend.Put(ctx, key, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "MISS", string(page))
+	if calls := env.fetcher.Calls(); len(calls) != 2 {
+		t.Errorf("fetched %v, want a refill", calls)
+	}
+	checkResponse(t, env.do("/zh/Pikachu", nil), http.StatusOK, "HIT", string(page))
+}
@@ -0,0 +1,53 @@
+package httpx
+
+import (
+	"context"
+	"time"
+
+	"github.com/52poke/inazuma/internal/lock"
+	"github.com/52poke/inazuma/internal/metrics"
+)
+
+// refreshPermitKey names the semaphore shared by all replicas that bounds
+// concurrent refreshes of expired pages.
+const refreshPermitKey = "semaphore:refresh"
+
+// acquireRefreshPermit takes a refresh permit, waiting up to
+// Cfg.RefreshPermitWaitMillis for one to free up. Without a permit the caller
+// serves the stale page instead.
+func (h *Handler) acquireRefreshPermit(ctx context.Context, ttl time.Duration) (lock.Lock, bool) {
+	start := time.Now()
+	deadline := start.Add(time.Duration(h.Cfg.RefreshPermitWaitMillis) * time.Millisecond)
+	limit := max(h.Cfg.RefreshConcurrency, 1)
+	observe := func(result string) {
+		metrics.RefreshPermitWait.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}
+	for {
+		permit, ok, err := h.Refreshes.TryAcquire(ctx, refreshPermitKey, limit, ttl)
+		if err != nil {
+			observe("error")
+			return nil, false
+		}
+		if ok {
+			observe("acquired")
+			metrics.RefreshPermitsInUse.Inc()
+			return permit, true
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			observe("saturated")
+			return nil, false
+		}
+		select {
+		case <-ctx.Done():
+			observe("canceled")
+			return nil, false
+		case <-time.After(min(wait, pollInterval)):
+		}
+	}
+}
+
+func (h *Handler) releaseRefreshPermit(ctx context.Context, permit lock.Lock) {
+	metrics.RefreshPermitsInUse.Dec()
+	_ = permit.Unlock(ctx)
+}
@@ -0,0 +1,121 @@
+package httpx
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxSpoolMemory bounds how far a client may lag behind a fill before its
+// copy of the page is spooled to a temporary file.
+const maxSpoolMemory = 1 << 20
+
+// spool buffers the client's copy of a fill, so that the upstream read, and
+// with it the cache write, never waits for a slow client. Up to limit pending
+// bytes are kept in memory; once the client falls further behind, the rest
+// goes to a temporary file. Writes never block on the reader.
+type spool struct {
+	limit int
+
+	mu        sync.Mutex
+	cond      sync.Cond
+	mem       bytes.Buffer
+	file      *os.File
+	wOff      int64
+	rOff      int64
+	done      bool
+	err       error
+	abandoned bool
+}
+
+func newSpool(limit int) *spool {
+	s := &spool{limit: limit}
+	s.cond.L = &s.mu
+	return s
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.abandoned {
+		return len(p), nil
+	}
+	if s.file == nil && s.mem.Len()+len(p) <= s.limit {
+		s.mem.Write(p)
+		s.cond.Signal()
+		return len(p), nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "inazuma-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+	}
+	n, err := s.file.WriteAt(p, s.wOff)
+	s.wOff += int64(n)
+	s.cond.Signal()
+	return n, err
+}
+
+// Read returns the spooled bytes in order, blocking until more are written.
+// Once everything is read it returns the error passed to CloseWrite, or
+// io.EOF.
+func (s *spool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.mem.Len() == 0 && s.rOff == s.wOff && !s.done {
+		s.cond.Wait()
+	}
+	// Bytes only go to the file once it exists, so memory is read first.
+	if s.mem.Len() > 0 {
+		return s.mem.Read(p)
+	}
+	if s.rOff < s.wOff {
+		if pending := s.wOff - s.rOff; int64(len(p)) > pending {
+			p = p[:pending]
+		}
+		n, err := s.file.ReadAt(p, s.rOff)
+		s.rOff += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, io.EOF
+}
+
+// CloseWrite marks the end of the data. A non-nil err is returned to the
+// reader in place of io.EOF.
+func (s *spool) CloseWrite(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// Abandon discards everything written from now on, for when the client is
+// gone.
+func (s *spool) Abandon() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandoned = true
+	s.mem = bytes.Buffer{}
+}
+
+// Close removes the temporary file, if any. It must only be called once both
+// sides are done.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
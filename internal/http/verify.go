@@ -0,0 +1,66 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/metrics"
+)
+
+// load gets key from the cache. Bodies up to Cfg.VerifyMaxBytes are read
+// before anything is written so that a corrupted object is discarded and
+// reported as a miss, which refills it through getWithLock. Larger bodies are
+// streamed and only discarded once the corruption shows up at their end, and
+// bodies the store already verified are served as they are.
+func (h *Handler) load(ctx context.Context, key string) (cache.Object, error) {
+	obj, err := h.Cache.Get(ctx, key)
+	if errors.Is(err, cache.ErrCorrupted) {
+		h.discardCorrupted(ctx, key, err)
+		return cache.Object{}, cache.ErrNotFound
+	}
+	if err != nil || obj.Verified {
+		return obj, err
+	}
+	obj.Body = &corruptionReader{ctx: ctx, h: h, key: key, ReadCloser: obj.Body}
+	if obj.Size < 0 || obj.Size > h.Cfg.VerifyMaxBytes {
+		return obj, nil
+	}
+
+	data, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		if errors.Is(err, cache.ErrCorrupted) {
+			return cache.Object{}, cache.ErrNotFound
+		}
+		return cache.Object{}, err
+	}
+	obj.Body = io.NopCloser(bytes.NewReader(data))
+	return obj, nil
+}
+
+func (h *Handler) discardCorrupted(ctx context.Context, key string, err error) {
+	log.Printf("cache: discarding %s: %v", key, err)
+	metrics.CorruptedObjects.Inc()
+	if err := h.Cache.Delete(context.WithoutCancel(ctx), key); err != nil {
+		log.Printf("cache: delete %s: %v", key, err)
+	}
+}
+
+type corruptionReader struct {
+	io.ReadCloser
+	ctx context.Context
+	h   *Handler
+	key string
+}
+
+func (c *corruptionReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if errors.Is(err, cache.ErrCorrupted) {
+		c.h.discardCorrupted(c.ctx, c.key, err)
+	}
+	return n, err
+}
@@ -0,0 +1,49 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// KeepAlive extends l to ttl every third of ttl, so work that outlives the
+// TTL keeps the lock. It stops once the lock is lost, ctx is done or the
+// returned function is called; that function waits for the heartbeat to
+// finish, so it must run before l is released:
+//
+//	defer l.Unlock(ctx)
+//	defer lock.KeepAlive(ctx, l, ttl)()
+func KeepAlive(ctx context.Context, l Lock, ttl time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(max(ttl/3, time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			ok, err := l.Extend(ctx, ttl)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					log.Printf("lock: extend: %v", err)
+				}
+				// A failed call may be transient; the next tick retries
+				// while the lock has not expired yet.
+				continue
+			}
+			if !ok {
+				log.Printf("lock: lost before the work it guards finished")
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
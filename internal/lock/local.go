@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LocalLocker is an in-process Locker. It only excludes callers sharing the
+// same LocalLocker, so it suits tests and single-instance deployments.
+type LocalLocker struct {
+	mu    sync.Mutex
+	locks map[string]localEntry
+}
+
+type localEntry struct {
+	token     string
+	expiresAt time.Time
+}
+
+func NewLocalLocker() *LocalLocker {
+	return &LocalLocker{locks: make(map[string]localEntry)}
+}
+
+func (l *LocalLocker) TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, bool, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if entry, ok := l.locks[key]; ok && now.Before(entry.expiresAt) {
+		return nil, false, nil
+	}
+	// Drop expired entries now and then so abandoned keys do not pile up.
+	if len(l.locks) > 1024 {
+		for k, entry := range l.locks {
+			if !now.Before(entry.expiresAt) {
+				delete(l.locks, k)
+			}
+		}
+	}
+	l.locks[key] = localEntry{token: token, expiresAt: now.Add(ttl)}
+	return &localLock{locker: l, key: key, token: token}, true, nil
+}
+
+type localLock struct {
+	locker *LocalLocker
+	key    string
+	token  string
+}
+
+func (l *localLock) Unlock(ctx context.Context) error {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+	if entry, ok := l.locker.locks[l.key]; ok && entry.token == l.token {
+		delete(l.locker.locks, l.key)
+	}
+	return nil
+}
+
+func (l *localLock) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+	now := time.Now()
+	entry, ok := l.locker.locks[l.key]
+	if !ok || entry.token != l.token || !now.Before(entry.expiresAt) {
+		return false, nil
+	}
+	l.locker.locks[l.key] = localEntry{token: l.token, expiresAt: now.Add(ttl)}
+	return true, nil
+}
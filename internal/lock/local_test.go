@@ -0,0 +1,82 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalLocker(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocalLocker()
+
+	l, ok, err := locker.TryLock(ctx, "key", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("TryLock = %v, %v", ok, err)
+	}
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); ok {
+		t.Fatal("acquired a held lock")
+	}
+	if _, ok, _ := locker.TryLock(ctx, "other", time.Minute); !ok {
+		t.Fatal("could not acquire an unrelated key")
+	}
+	if err := l.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); !ok {
+		t.Fatal("could not acquire a released lock")
+	}
+}
+
+func TestLocalLockerExpiry(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocalLocker()
+
+	stale, _, _ := locker.TryLock(ctx, "key", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	fresh, ok, _ := locker.TryLock(ctx, "key", time.Minute)
+	if !ok {
+		t.Fatal("expired lock was not released")
+	}
+	// The expired owner must not release the new owner's lock.
+	_ = stale.Unlock(ctx)
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); ok {
+		t.Fatal("stale unlock released the new owner's lock")
+	}
+	_ = fresh.Unlock(ctx)
+}
+
+func TestLocalLockerExtend(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocalLocker()
+
+	l, _, _ := locker.TryLock(ctx, "key", 20*time.Millisecond)
+	if ok, err := l.Extend(ctx, time.Minute); err != nil || !ok {
+		t.Fatalf("Extend = %v, %v", ok, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); ok {
+		t.Fatal("extended lock expired")
+	}
+	_ = l.Unlock(ctx)
+	if ok, _ := l.Extend(ctx, time.Minute); ok {
+		t.Fatal("extended a released lock")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocalLocker()
+
+	l, _, _ := locker.TryLock(ctx, "key", 30*time.Millisecond)
+	stop := KeepAlive(ctx, l, 30*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); ok {
+		t.Fatal("lock expired while kept alive")
+	}
+	stop()
+	time.Sleep(50 * time.Millisecond)
+	if _, ok, _ := locker.TryLock(ctx, "key", time.Minute); !ok {
+		t.Fatal("lock still held after the heartbeat stopped")
+	}
+}
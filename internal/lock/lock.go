@@ -0,0 +1,22 @@
+package lock
+
+import (
+	"context"
+	"time"
+)
+
+// Locker hands out locks that expire after ttl unless released earlier.
+type Locker interface {
+	// TryLock acquires key without waiting. It returns false when the key is
+	// held by someone else.
+	TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, bool, error)
+}
+
+type Lock interface {
+	// Unlock releases the lock if it is still held by this owner.
+	Unlock(ctx context.Context) error
+	// Extend resets the lock to expire ttl from now. It returns false, and
+	// leaves the key alone, when the lock has expired or passed to another
+	// owner.
+	Extend(ctx context.Context, ttl time.Duration) (bool, error)
+}
@@ -0,0 +1,93 @@
+package lock
+
+import (
+	"context"
+	"sync"
+)
+
+// Notifier wakes up requests waiting for the holder of a lock to finish, so
+// they do not have to poll for the result.
+type Notifier interface {
+	// Subscribe starts listening for notifications of key. Subscribe before
+	// checking whether the work is done, or a notification sent in between
+	// is missed.
+	Subscribe(ctx context.Context, key string) (*Subscription, error)
+	// Notify wakes up every subscriber of key.
+	Notify(ctx context.Context, key string) error
+}
+
+// Subscription receives a value on C whenever its key is notified.
+// Notifications are best effort: waiters must still give up or re-check
+// eventually.
+type Subscription struct {
+	C <-chan struct{}
+
+	close func()
+}
+
+// Close stops listening. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.close()
+}
+
+// hub fans notifications out to the subscriptions of this process.
+type hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func (h *hub) subscribe(key string) *Subscription {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[string]map[chan struct{}]struct{})
+	}
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan struct{}]struct{})
+	}
+	h.subs[key][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return &Subscription{C: ch, close: func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs[key], ch)
+			if len(h.subs[key]) == 0 {
+				delete(h.subs, key)
+			}
+		})
+	}}
+}
+
+func (h *hub) notify(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[key] {
+		// A pending notification already wakes the subscriber up.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LocalNotifier only reaches subscribers in the same process, matching
+// LocalLocker.
+type LocalNotifier struct {
+	hub hub
+}
+
+func NewLocalNotifier() *LocalNotifier {
+	return &LocalNotifier{}
+}
+
+func (n *LocalNotifier) Subscribe(ctx context.Context, key string) (*Subscription, error) {
+	return n.hub.subscribe(key), nil
+}
+
+func (n *LocalNotifier) Notify(ctx context.Context, key string) error {
+	n.hub.notify(key)
+	return nil
+}
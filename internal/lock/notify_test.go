@@ -0,0 +1,45 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalNotifier(t *testing.T) {
+	ctx := context.Background()
+	n := NewLocalNotifier()
+
+	sub, err := n.Subscribe(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := n.Subscribe(ctx, "other")
+	defer other.Close()
+
+	// Notifications before the subscriber waits are kept, and repeated
+	// ones coalesce.
+	_ = n.Notify(ctx, "key")
+	_ = n.Notify(ctx, "key")
+	select {
+	case <-sub.C:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not notified")
+	}
+	select {
+	case <-sub.C:
+		t.Fatal("notified twice")
+	case <-other.C:
+		t.Fatal("notified a subscriber of another key")
+	default:
+	}
+
+	sub.Close()
+	sub.Close()
+	_ = n.Notify(ctx, "key")
+	select {
+	case <-sub.C:
+		t.Fatal("notified a closed subscription")
+	default:
+	}
+}
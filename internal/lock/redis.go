@@ -4,26 +4,36 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisLock struct {
-	client *redis.Client
+	client redis.UniversalClient
 	key    string
 	token  string
 }
 
-func NewRedisClient(addr, password string, db int) *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
+// RedisLocker is a Locker shared by all replicas using the same Redis.
+type RedisLocker struct {
+	client redis.UniversalClient
 }
 
-func TryLock(ctx context.Context, client *redis.Client, key string, ttl time.Duration) (*RedisLock, bool, error) {
+func NewRedisLocker(client redis.UniversalClient) *RedisLocker {
+	return &RedisLocker{client: client}
+}
+
+func (l *RedisLocker) TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, bool, error) {
+	rl, ok, err := TryLock(ctx, l.client, key, ttl)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	return rl, true, nil
+}
+
+func TryLock(ctx context.Context, client redis.UniversalClient, key string, ttl time.Duration) (*RedisLock, bool, error) {
 	token, err := newToken()
 	if err != nil {
 		return nil, false, err
@@ -50,6 +60,149 @@ end
 	return err
 }
 
+func (l *RedisLock) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	const script = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end
+`
+	n, err := l.client.Eval(ctx, script, []string{l.key}, l.token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RedisSemaphore keeps the permits of each key in a sorted set of holder
+// tokens scored by their expiry in Redis server time, so replicas with
+// skewed clocks agree on when a permit lapses.
+type RedisSemaphore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisSemaphore(client redis.UniversalClient) *RedisSemaphore {
+	return &RedisSemaphore{client: client}
+}
+
+// redisNow is a Lua prelude setting now to the Redis server time in
+// milliseconds.
+const redisNow = `
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+func (s *RedisSemaphore) TryAcquire(ctx context.Context, key string, limit int, ttl time.Duration) (Lock, bool, error) {
+	const script = redisNow + `
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`
+	token, err := newToken()
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := s.client.Eval(ctx, script, []string{key}, token, limit, ttl.Milliseconds()).Int()
+	if err != nil || n == 0 {
+		return nil, false, err
+	}
+	return &redisPermit{client: s.client, key: key, token: token}, true, nil
+}
+
+type redisPermit struct {
+	client redis.UniversalClient
+	key    string
+	token  string
+}
+
+func (p *redisPermit) Unlock(ctx context.Context) error {
+	return p.client.ZRem(ctx, p.key, p.token).Err()
+}
+
+func (p *redisPermit) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	const script = redisNow + `
+local expiresAt = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not expiresAt or tonumber(expiresAt) <= now then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`
+	n, err := p.client.Eval(ctx, script, []string{p.key}, p.token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RedisNotifier publishes notifications on a Redis channel, reaching
+// subscribers on every replica. Each process holds one subscription to the
+// channel, opened on first use. Notifications published while that
+// connection is down are lost.
+type RedisNotifier struct {
+	client  redis.UniversalClient
+	channel string
+	hub     hub
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+}
+
+func NewRedisNotifier(client redis.UniversalClient, channel string) *RedisNotifier {
+	return &RedisNotifier{client: client, channel: channel}
+}
+
+func (n *RedisNotifier) Subscribe(ctx context.Context, key string) (*Subscription, error) {
+	if err := n.listen(ctx); err != nil {
+		return nil, err
+	}
+	return n.hub.subscribe(key), nil
+}
+
+func (n *RedisNotifier) Notify(ctx context.Context, key string) error {
+	return n.client.Publish(ctx, n.channel, key).Err()
+}
+
+func (n *RedisNotifier) listen(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pubsub != nil {
+		return nil
+	}
+	pubsub := n.client.Subscribe(context.Background(), n.channel)
+	// Wait for the subscription to be confirmed so no notification sent
+	// after Subscribe returns is missed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return err
+	}
+	n.pubsub = pubsub
+	go func() {
+		for msg := range pubsub.Channel() {
+			n.hub.notify(msg.Payload)
+		}
+	}()
+	return nil
+}
+
+// Close stops listening for notifications.
+func (n *RedisNotifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pubsub == nil {
+		return nil
+	}
+	err := n.pubsub.Close()
+	n.pubsub = nil
+	return err
+}
+
 func newToken() (string, error) {
 	buf := make([]byte, 16)
 	_, err := rand.Read(buf)
@@ -0,0 +1,186 @@
+package lock
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis connects to the Redis at INAZUMA_TEST_REDIS_ADDR and returns a
+// random prefix for the test's keys, which are deleted afterwards.
+func newTestRedis(t *testing.T) (redis.UniversalClient, string) {
+	addr := os.Getenv("INAZUMA_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("INAZUMA_TEST_REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "inazuma-test:" + token + ":"
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := client.Keys(ctx, prefix+"*").Result()
+		if len(keys) > 0 {
+			client.Del(ctx, keys...)
+		}
+	})
+	return client, prefix
+}
+
+func TestRedisLock(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := newTestRedis(t)
+	locker := NewRedisLocker(client)
+	key := prefix + "lock"
+
+	l, ok, err := locker.TryLock(ctx, key, 100*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("TryLock = %v, %v", ok, err)
+	}
+	if _, ok, _ := locker.TryLock(ctx, key, time.Minute); ok {
+		t.Fatal("locked a held key")
+	}
+	if ok, err := l.Extend(ctx, time.Minute); err != nil || !ok {
+		t.Fatalf("Extend = %v, %v", ok, err)
+	}
+	if ttl := client.PTTL(ctx, key).Val(); ttl < 30*time.Second {
+		t.Errorf("TTL after Extend = %v, want about a minute", ttl)
+	}
+
+	// Only the holder's token extends or releases the lock.
+	other := &RedisLock{client: client, key: key, token: "other"}
+	if ok, _ := other.Extend(ctx, time.Hour); ok {
+		t.Error("extended a lock held by another token")
+	}
+	if ttl := client.PTTL(ctx, key).Val(); ttl > time.Minute {
+		t.Errorf("TTL = %v after a foreign Extend", ttl)
+	}
+	_ = other.Unlock(ctx)
+	if _, ok, _ := locker.TryLock(ctx, key, time.Minute); ok {
+		t.Fatal("a foreign Unlock released the lock")
+	}
+
+	if err := l.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Extend(ctx, time.Minute); ok {
+		t.Error("extended a released lock")
+	}
+
+	expired, _, _ := locker.TryLock(ctx, prefix+"expired", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if ok, _ := expired.Extend(ctx, time.Minute); ok {
+		t.Error("extended an expired lock")
+	}
+}
+
+func TestRedisNotifier(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := newTestRedis(t)
+	// Two notifiers on one channel stand for two replicas.
+	n := NewRedisNotifier(client, prefix+"fills")
+	defer n.Close()
+	replica := NewRedisNotifier(client, prefix+"fills")
+	defer replica.Close()
+	elsewhere := NewRedisNotifier(client, prefix+"other-fills")
+	defer elsewhere.Close()
+
+	sub, err := n.Subscribe(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	other, err := n.Subscribe(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := elsewhere.Notify(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.C:
+		t.Fatal("notified by a notifier on another channel")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := replica.Notify(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.C:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscriber was not notified through Redis")
+	}
+	select {
+	case <-other.C:
+		t.Fatal("notified a subscriber of another key")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisSemaphore(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := newTestRedis(t)
+	sem := NewRedisSemaphore(client)
+	key := prefix + "refresh"
+
+	var permits []Lock
+	for range 3 {
+		p, ok, err := sem.TryAcquire(ctx, key, 3, time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("TryAcquire = %v, %v", ok, err)
+		}
+		permits = append(permits, p)
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, key, 3, time.Minute); ok {
+		t.Fatal("acquired more permits than the limit")
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, prefix+"other", 3, time.Minute); !ok {
+		t.Fatal("could not acquire a permit of an unrelated key")
+	}
+	if err := permits[0].Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, key, 3, time.Minute); !ok {
+		t.Fatal("could not acquire a released permit")
+	}
+}
+
+func TestRedisSemaphoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := newTestRedis(t)
+	sem := NewRedisSemaphore(client)
+
+	stale, ok, err := sem.TryAcquire(ctx, prefix+"key", 1, 50*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("TryAcquire = %v, %v", ok, err)
+	}
+	kept, ok, err := sem.TryAcquire(ctx, prefix+"kept", 1, 50*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("TryAcquire = %v, %v", ok, err)
+	}
+	if ok, err := kept.Extend(ctx, time.Minute); err != nil || !ok {
+		t.Fatalf("Extend = %v, %v", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok, _ := sem.TryAcquire(ctx, prefix+"key", 1, time.Minute); !ok {
+		t.Fatal("expired permit was not released")
+	}
+	if ok, _ := stale.Extend(ctx, time.Minute); ok {
+		t.Fatal("extended an expired permit")
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, prefix+"kept", 1, time.Minute); ok {
+		t.Fatal("extended permit expired")
+	}
+}
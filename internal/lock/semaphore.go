@@ -0,0 +1,80 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Semaphore hands out up to limit permits per key. Like locks, permits expire
+// after ttl unless released or extended first, so a crashed holder does not
+// keep its permit.
+type Semaphore interface {
+	// TryAcquire takes a permit for key without waiting. It returns false
+	// when all limit permits are taken.
+	TryAcquire(ctx context.Context, key string, limit int, ttl time.Duration) (Lock, bool, error)
+}
+
+// LocalSemaphore is an in-process Semaphore, the counterpart of LocalLocker.
+type LocalSemaphore struct {
+	mu      sync.Mutex
+	permits map[string]map[string]time.Time
+}
+
+func NewLocalSemaphore() *LocalSemaphore {
+	return &LocalSemaphore{permits: make(map[string]map[string]time.Time)}
+}
+
+func (s *LocalSemaphore) TryAcquire(ctx context.Context, key string, limit int, ttl time.Duration) (Lock, bool, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	held := s.permits[key]
+	for t, expiresAt := range held {
+		if !now.Before(expiresAt) {
+			delete(held, t)
+		}
+	}
+	if len(held) >= limit {
+		return nil, false, nil
+	}
+	if held == nil {
+		held = make(map[string]time.Time)
+		s.permits[key] = held
+	}
+	held[token] = now.Add(ttl)
+	return &localPermit{sem: s, key: key, token: token}, true, nil
+}
+
+type localPermit struct {
+	sem   *LocalSemaphore
+	key   string
+	token string
+}
+
+func (p *localPermit) Unlock(ctx context.Context) error {
+	p.sem.mu.Lock()
+	defer p.sem.mu.Unlock()
+	delete(p.sem.permits[p.key], p.token)
+	if len(p.sem.permits[p.key]) == 0 {
+		delete(p.sem.permits, p.key)
+	}
+	return nil
+}
+
+func (p *localPermit) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	p.sem.mu.Lock()
+	defer p.sem.mu.Unlock()
+	now := time.Now()
+	expiresAt, ok := p.sem.permits[p.key][p.token]
+	if !ok || !now.Before(expiresAt) {
+		return false, nil
+	}
+	p.sem.permits[p.key][p.token] = now.Add(ttl)
+	return true, nil
+}
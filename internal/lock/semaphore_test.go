@@ -0,0 +1,52 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalSemaphore(t *testing.T) {
+	ctx := context.Background()
+	sem := NewLocalSemaphore()
+
+	var permits []Lock
+	for range 3 {
+		p, ok, err := sem.TryAcquire(ctx, "key", 3, time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("TryAcquire = %v, %v", ok, err)
+		}
+		permits = append(permits, p)
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, "key", 3, time.Minute); ok {
+		t.Fatal("acquired more permits than the limit")
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, "other", 3, time.Minute); !ok {
+		t.Fatal("could not acquire a permit of an unrelated key")
+	}
+	_ = permits[0].Unlock(ctx)
+	if _, ok, _ := sem.TryAcquire(ctx, "key", 3, time.Minute); !ok {
+		t.Fatal("could not acquire a released permit")
+	}
+}
+
+func TestLocalSemaphoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	sem := NewLocalSemaphore()
+
+	stale, _, _ := sem.TryAcquire(ctx, "key", 1, 10*time.Millisecond)
+	kept, _, _ := sem.TryAcquire(ctx, "kept", 1, 10*time.Millisecond)
+	if ok, _ := kept.Extend(ctx, time.Minute); !ok {
+		t.Fatal("could not extend a held permit")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := sem.TryAcquire(ctx, "key", 1, time.Minute); !ok {
+		t.Fatal("expired permit was not released")
+	}
+	if ok, _ := stale.Extend(ctx, time.Minute); ok {
+		t.Fatal("extended an expired permit")
+	}
+	if _, ok, _ := sem.TryAcquire(ctx, "kept", 1, time.Minute); ok {
+		t.Fatal("extended permit expired")
+	}
+}
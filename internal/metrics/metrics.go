@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "inazuma"
+
+var (
+	StoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of cache store operations. For get it is the time to the first byte of the body.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"backend", "op"})
+
+	StoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "errors_total",
+		Help:      "Failed cache store operations by error type. not_found is counted separately from real failures.",
+	}, []string{"backend", "op", "type"})
+
+	StoreReadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "read_bytes_total",
+		Help:      "Object body bytes read from the cache store.",
+	}, []string{"backend"})
+
+	StoreWrittenBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "written_bytes_total",
+		Help:      "Object body bytes written to the cache store.",
+	}, []string{"backend"})
+
+	CorruptedObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "corrupted_objects_total",
+		Help:      "Cached objects discarded because their body did not match the stored checksum.",
+	})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "breaker_state",
+		Help:      "Circuit breaker state of the cache store; 1 for the current state, 0 otherwise.",
+	}, []string{"backend", "state"})
+
+	BreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "breaker_transitions_total",
+		Help:      "Circuit breaker state changes of the cache store, by the state entered.",
+	}, []string{"backend", "state"})
+
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Page requests that waited for a concurrent request for the same page, by whether its response was shared with them.",
+	}, []string{"result"})
+
+	RefreshPermitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "refresh",
+		Name:      "permit_wait_seconds",
+		Help:      "Time spent acquiring a permit to refresh an expired page, by result: acquired, saturated when none freed up in time, canceled or error.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"result"})
+
+	RefreshPermitsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "refresh",
+		Name:      "permits_in_use",
+		Help:      "Refresh permits held by this instance.",
+	})
+)
+
+// Handler serves the process metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -2,51 +2,50 @@ package mw
 
 import (
 	"context"
-	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
+// Fetcher requests pages from MediaWiki. The caller must close the response
+// body.
+type Fetcher interface {
+	Fetch(ctx context.Context, path string, rawQuery string, headers http.Header) (*http.Response, error)
+}
+
 type Client struct {
 	baseURL string
 	http    *http.Client
 }
 
-func NewClient(baseURL string) *Client {
+// NewClient returns a Client giving up on requests, including reading the
+// body, after timeout.
+func NewClient(baseURL string, timeout time.Duration) *Client {
 	return &Client{
 		baseURL: strings.TrimRight(baseURL, "/"),
 		http: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout: timeout,
 		},
 	}
 }
 
-func (c *Client) Fetch(ctx context.Context, path string, rawQuery string, headers http.Header) (*http.Response, []byte, error) {
+// Fetch requests path from MediaWiki. The caller must close the response body.
+func (c *Client) Fetch(ctx context.Context, path string, rawQuery string, headers http.Header) (*http.Response, error) {
 	u, err := url.Parse(c.baseURL)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	u.Path = strings.TrimRight(u.Path, "/") + path
 	u.RawQuery = rawQuery
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	copyHeaders(req.Header, headers)
 
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-	return resp, body, nil
+	return c.http.Do(req)
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -0,0 +1,74 @@
+// Package mwtest provides an in-memory mw.Fetcher for tests.
+package mwtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Page is a canned MediaWiki response. A zero Status means 200.
+type Page struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// Fetcher serves Pages by path and answers 404 for anything else. Bodies are
+// sent uncompressed whatever the request asks for.
+type Fetcher struct {
+	mu    sync.Mutex
+	pages map[string]Page
+	calls []string
+}
+
+func NewFetcher() *Fetcher {
+	return &Fetcher{pages: make(map[string]Page)}
+}
+
+// Set serves page for path from now on.
+func (f *Fetcher) Set(path string, page Page) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pages[path] = page
+}
+
+// Calls returns the paths fetched so far.
+func (f *Fetcher) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *Fetcher) Fetch(ctx context.Context, path string, rawQuery string, headers http.Header) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, path)
+	page, ok := f.pages[path]
+	f.mu.Unlock()
+
+	if !ok {
+		page = Page{Status: http.StatusNotFound, Body: "not found"}
+	}
+	status := page.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := page.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(page.Body)))
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(page.Body)),
+		ContentLength: int64(len(page.Body)),
+	}, nil
+}
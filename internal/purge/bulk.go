@@ -0,0 +1,242 @@
+package purge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/lang"
+)
+
+// BulkRequest selects the objects removed by a bulk purge. Exactly one of
+// KeyPrefix, TitlePrefix and Namespace must be set; the latter two apply to
+// Variants, or to every variant when Variants is empty.
+type BulkRequest struct {
+	KeyPrefix   string   `json:"key_prefix,omitempty"`
+	TitlePrefix string   `json:"title_prefix,omitempty"`
+	Namespace   string   `json:"namespace,omitempty"`
+	Variants    []string `json:"variants,omitempty"`
+}
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job tracks a bulk purge. Counters are updated after every listed page.
+type Job struct {
+	ID          string      `json:"id"`
+	Request     BulkRequest `json:"request"`
+	State       string      `json:"state"`
+	Scanned     int64       `json:"scanned"`
+	Deleted     int64       `json:"deleted"`
+	Bytes       int64       `json:"bytes"`
+	NginxErrors int64       `json:"nginx_errors"`
+	Error       string      `json:"error,omitempty"`
+	StartedAt   time.Time   `json:"started_at"`
+	FinishedAt  *time.Time  `json:"finished_at,omitempty"`
+}
+
+const (
+	bulkListLimit = 1000
+	maxKeptJobs   = 100
+)
+
+var allVariants = []string{lang.VariantZH, lang.VariantHans, lang.VariantHant}
+
+// Prefixes returns the key prefixes covered by r.
+func (r BulkRequest) Prefixes() ([]string, error) {
+	set := 0
+	for _, v := range []string{r.KeyPrefix, r.TitlePrefix, r.Namespace} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of key_prefix, title_prefix and namespace is required")
+	}
+	if r.KeyPrefix != "" {
+		if len(r.Variants) > 0 {
+			return nil, errors.New("variants cannot be combined with key_prefix")
+		}
+		return []string{r.KeyPrefix}, nil
+	}
+
+	titlePrefix := r.TitlePrefix
+	if r.Namespace != "" {
+		titlePrefix = r.Namespace + ":"
+	}
+	variants := r.Variants
+	if len(variants) == 0 {
+		variants = allVariants
+	}
+	prefixes := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		if !isVariant(variant) {
+			return nil, fmt.Errorf("unknown variant %q", variant)
+		}
+		prefixes = append(prefixes, cache.PageKeyPrefix(variant, titlePrefix))
+	}
+	return prefixes, nil
+}
+
+// Bulk deletes every object matching req and returns the finished job.
+func (h *Handler) Bulk(ctx context.Context, req BulkRequest) (Job, error) {
+	job, err := h.newJob(req)
+	if err != nil {
+		return Job{}, err
+	}
+	h.runJob(ctx, job)
+	return h.jobSnapshot(job), nil
+}
+
+// StartBulk runs a bulk purge in the background and returns its job right
+// away; poll its progress with Job.
+func (h *Handler) StartBulk(req BulkRequest) (Job, error) {
+	job, err := h.newJob(req)
+	if err != nil {
+		return Job{}, err
+	}
+	go h.runJob(context.Background(), job)
+	return h.jobSnapshot(job), nil
+}
+
+// Job returns the current state of a bulk purge started by this process.
+func (h *Handler) Job(id string) (Job, bool) {
+	h.jobsMu.Lock()
+	job, ok := h.jobs[id]
+	h.jobsMu.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	return h.jobSnapshot(job), true
+}
+
+func (h *Handler) newJob(req BulkRequest) (*Job, error) {
+	if _, err := req.Prefixes(); err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: id, Request: req, State: JobRunning, StartedAt: time.Now().UTC()}
+
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	if h.jobs == nil {
+		h.jobs = map[string]*Job{}
+	}
+	h.jobs[id] = job
+	h.jobOrder = append(h.jobOrder, id)
+	h.pruneJobsLocked()
+	return job, nil
+}
+
+func (h *Handler) runJob(ctx context.Context, job *Job) {
+	prefixes, _ := job.Request.Prefixes()
+	var err error
+	for _, prefix := range prefixes {
+		if err = h.purgePrefix(ctx, job, prefix); err != nil {
+			break
+		}
+	}
+
+	h.updateJob(job, func(j *Job) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		j.State = JobDone
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+	})
+}
+
+func (h *Handler) purgePrefix(ctx context.Context, job *Job, prefix string) error {
+	opts := cache.ListOptions{Prefix: prefix, Limit: bulkListLimit}
+	for {
+		page, err := cache.List(ctx, h.Cache, opts)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(page.Entries))
+		var size int64
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+			size += entry.Size
+		}
+		h.updateJob(job, func(j *Job) { j.Scanned += int64(len(keys)) })
+		if err := cache.DeleteMany(ctx, h.Cache, keys); err != nil {
+			return err
+		}
+		h.updateJob(job, func(j *Job) {
+			j.Deleted += int64(len(keys))
+			j.Bytes += size
+		})
+
+		var nginxErrors int64
+		for _, key := range keys {
+			variant, title, ok := cache.ParsePageKey(key)
+			if !ok {
+				continue
+			}
+			if err := h.purgeNginx(ctx, variantPath(variant, title)); err != nil {
+				nginxErrors++
+			}
+		}
+		h.updateJob(job, func(j *Job) { j.NginxErrors += nginxErrors })
+
+		if page.Cursor == "" {
+			return nil
+		}
+		opts.Cursor = page.Cursor
+	}
+}
+
+func (h *Handler) updateJob(job *Job, update func(*Job)) {
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	update(job)
+}
+
+func (h *Handler) jobSnapshot(job *Job) Job {
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	return *job
+}
+
+// pruneJobsLocked forgets the oldest finished jobs beyond maxKeptJobs.
+func (h *Handler) pruneJobsLocked() {
+	for i := 0; len(h.jobOrder) > maxKeptJobs && i < len(h.jobOrder); {
+		id := h.jobOrder[i]
+		if h.jobs[id].State == JobRunning {
+			i++
+			continue
+		}
+		delete(h.jobs, id)
+		h.jobOrder = append(h.jobOrder[:i], h.jobOrder[i+1:]...)
+	}
+}
+
+func isVariant(v string) bool {
+	for _, known := range allVariants {
+		if v == known {
+			return true
+		}
+	}
+	return false
+}
+
+func newJobID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
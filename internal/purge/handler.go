@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/52poke/inazuma/internal/cache"
@@ -13,16 +14,30 @@ import (
 	"github.com/52poke/inazuma/internal/lang"
 	"github.com/52poke/inazuma/internal/lock"
 	"github.com/52poke/inazuma/internal/mw"
-	"github.com/redis/go-redis/v9"
+	"github.com/52poke/inazuma/internal/ttl"
 )
 
 type Handler struct {
 	Cache      cache.Store
-	MW         *mw.Client
-	Redis      *redis.Client
+	MW         mw.Fetcher
+	Locks      lock.Locker
 	NginxPurge string
 	LockTTL    time.Duration
 	HTTPClient *http.Client
+	// Encoding is the content coding pages are stored in.
+	Encoding string
+	// Headers lists the upstream response headers stored with pages.
+	Headers []string
+	// TTL, if set, gives the TTL recorded with refreshed pages; otherwise
+	// DefaultTTL is recorded, like httpx.Handler does without rules.
+	TTL        *ttl.Rules
+	DefaultTTL time.Duration
+	// Fills, if set, is notified when a refresh finishes; see httpx.Handler.
+	Fills lock.Notifier
+
+	jobsMu   sync.Mutex
+	jobs     map[string]*Job
+	jobOrder []string
 }
 
 const purgeTimestampHeader = "X-Purge-Timestamp"
@@ -103,14 +118,18 @@ func (h *Handler) refreshVariant(ctx context.Context, title, variant string, pur
 	}
 
 	lockKey := "lock:" + key
-	l, ok, err := lock.TryLock(ctx, h.Redis, lockKey, h.LockTTL)
+	l, ok, err := h.Locks.TryLock(ctx, lockKey, h.LockTTL)
 	if err != nil {
 		return err
 	}
 	if !ok {
 		return nil
 	}
+	if h.Fills != nil {
+		defer h.Fills.Notify(ctx, key)
+	}
 	defer l.Unlock(ctx)
+	defer lock.KeepAlive(ctx, l, h.LockTTL)()
 
 	updatedAt, err = h.Cache.UpdatedAt(ctx, key)
 	if err == nil && updatedAt.After(purgeTime) {
@@ -121,31 +140,32 @@ func (h *Handler) refreshVariant(ctx context.Context, title, variant string, pur
 	}
 
 	path := variantPath(variant, title)
-	resp, body, err := h.MW.Fetch(ctx, path, "", http.Header{})
+	f, err := httpx.FetchFill(ctx, h.MW, path, h.Encoding)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode < http.StatusInternalServerError {
+	defer f.Resp.Body.Close()
+	if f.Resp.StatusCode != http.StatusOK {
+		if f.Resp.StatusCode < http.StatusInternalServerError {
 			_ = h.Cache.Delete(ctx, key)
 			return nil
 		}
 		return errors.New("upstream non-200 response")
 	}
-
-	obj := cache.Object{
-		Body:        body,
-		ContentType: resp.Header.Get("Content-Type"),
-		Encoding:    resp.Header.Get("Content-Encoding"),
-		UpdatedAt:   time.Now().UTC(),
-	}
-	if err := h.Cache.Put(ctx, key, obj); err != nil {
+	if err := f.Store(ctx, h.Cache, key, h.Headers, h.pageTTL(variant, title)); err != nil {
 		return err
 	}
 
 	return h.purgeNginx(ctx, path)
 }
 
+func (h *Handler) pageTTL(variant, title string) time.Duration {
+	if h.TTL != nil {
+		return h.TTL.TTL(variant, title)
+	}
+	return h.DefaultTTL
+}
+
 func variantPath(variant, title string) string {
 	switch variant {
 	case lang.VariantHans:
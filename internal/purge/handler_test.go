@@ -0,0 +1,127 @@
+package purge
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52poke/inazuma/internal/cache"
+	"github.com/52poke/inazuma/internal/lock"
+	"github.com/52poke/inazuma/internal/mw/mwtest"
+	"github.com/52poke/inazuma/internal/ttl"
+)
+
+func newTestHandler(store cache.Store, fetcher *mwtest.Fetcher) *Handler {
+	rules, err := ttl.New(nil, time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	return &Handler{
+		Cache:    store,
+		MW:       fetcher,
+		Locks:    lock.NewLocalLocker(),
+		LockTTL:  10 * time.Second,
+		Encoding: "gzip",
+		TTL:      rules,
+	}
+}
+
+func purge(h *Handler, path string, ts time.Time) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PURGE", path, nil)
+	req.Header.Set(purgeTimestampHeader, ts.Format(time.RFC3339))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPurgeRefreshesAllVariants(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryStore()
+	fetcher := mwtest.NewFetcher()
+	for _, path := range []string{"/zh/Pikachu", "/zh-hans/Pikachu", "/zh-hant/Pikachu"} {
+		fetcher.Set(path, mwtest.Page{Body: "new " + path})
+	}
+	h := newTestHandler(store, fetcher)
+
+	if rec := purge(h, "/wiki/Pikachu", time.Now()); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	for _, variant := range []string{"zh", "zh-hans", "zh-hant"} {
+		obj, err := store.Head(ctx, cache.PageKey(variant, "Pikachu"))
+		if err != nil {
+			t.Fatalf("%s not stored: %v", variant, err)
+		}
+		if obj.Encoding != "gzip" {
+			t.Errorf("%s stored as %q, want gzip", variant, obj.Encoding)
+		}
+		// Purges record the same metadata as a miss.
+		if obj.Meta[ttl.MetaKey] != "3600" || obj.Meta[ttl.FillMetaKey] == "" {
+			t.Errorf("%s stored with metadata %v", variant, obj.Meta)
+		}
+	}
+
+	// Purges older than the stored copy are ignored.
+	purge(h, "/wiki/Pikachu", time.Now().Add(-time.Hour))
+	if calls := fetcher.Calls(); len(calls) != 3 {
+		t.Errorf("fetched %v, want one fetch per variant", calls)
+	}
+}
+
+func TestPurgeWithoutTTLRules(t *testing.T) {
+	store := cache.NewMemoryStore()
+	fetcher := mwtest.NewFetcher()
+	fetcher.Set("/zh/Pikachu", mwtest.Page{Body: "new"})
+	h := newTestHandler(store, fetcher)
+	h.TTL = nil
+	h.DefaultTTL = 30 * time.Minute
+
+	if rec := purge(h, "/zh/Pikachu", time.Now()); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	obj, err := store.Head(context.Background(), cache.PageKey("zh", "Pikachu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Meta[ttl.MetaKey] != "1800" {
+		t.Errorf("stored with metadata %v, want the default TTL", obj.Meta)
+	}
+}
+
+func TestPurgeDeletesMissingPage(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryStore()
+	key := cache.PageKey("zh", "Missingno")
+	err := store.Put(ctx, key, cache.Object{
+		Body:      io.NopCloser(strings.NewReader("old")),
+		Size:      3,
+		UpdatedAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(store, mwtest.NewFetcher())
+
+	if rec := purge(h, "/zh/Missingno", time.Now()); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := store.Head(ctx, key); err == nil {
+		t.Error("page missing upstream is still cached")
+	}
+}
+
+func TestPurgeRejectsBadRequests(t *testing.T) {
+	h := newTestHandler(cache.NewMemoryStore(), mwtest.NewFetcher())
+	if rec := purge(h, "/w/index.php", time.Now()); rec.Code != http.StatusBadRequest {
+		t.Errorf("unsupported path: status = %d", rec.Code)
+	}
+	req := httptest.NewRequest("PURGE", "/wiki/Pikachu", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("missing timestamp: status = %d", rec.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package ttl
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// FillMetaKey records how long MediaWiki took to render a page, in
+// milliseconds, for RefreshEarly.
+const FillMetaKey = "fill_ms"
+
+// Jitter shortens ttl by up to fraction of it. The amount is derived from key,
+// so a page always expires at the same point while pages stored together
+// spread their expiry over the window.
+func Jitter(ttl time.Duration, key string, fraction float64) time.Duration {
+	if ttl <= 0 || fraction <= 0 {
+		return ttl
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	unit := float64(h.Sum64()>>11) / (1 << 53)
+	return ttl - time.Duration(float64(ttl)*min(fraction, 1)*unit)
+}
+
+// RefreshEarly decides whether a page still fresh until expiresAt should be
+// refreshed now, following the XFetch algorithm: the chance grows as expiry
+// approaches and with the time the page takes to render, and every request
+// rolls again, so hot pages are refreshed ahead of expiry by a single request
+// while rarely read ones simply expire. beta scales how early; zero disables
+// it.
+func RefreshEarly(expiresAt time.Time, fill time.Duration, beta float64) bool {
+	if beta <= 0 || fill <= 0 {
+		return false
+	}
+	gap := time.Duration(float64(fill) * beta * -math.Log(1-rand.Float64()))
+	return !time.Now().Add(gap).Before(expiresAt)
+}
+
+// FormatFill returns the FillMetaKey value for d.
+func FormatFill(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// ParseFill reads a FillMetaKey value, returning zero when it is missing.
+func ParseFill(meta map[string]string) time.Duration {
+	ms, err := strconv.ParseInt(meta[FillMetaKey], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
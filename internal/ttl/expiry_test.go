@@ -0,0 +1,59 @@
+package ttl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	if got := Jitter(time.Hour, "page/a", 0); got != time.Hour {
+		t.Errorf("Jitter without fraction = %v", got)
+	}
+	if got := Jitter(0, "page/a", 0.1); got != 0 {
+		t.Errorf("Jitter of a zero TTL = %v", got)
+	}
+	if Jitter(time.Hour, "page/a", 0.1) != Jitter(time.Hour, "page/a", 0.1) {
+		t.Error("Jitter is not deterministic")
+	}
+
+	seen := make(map[time.Duration]bool)
+	for i := range 100 {
+		got := Jitter(time.Hour, fmt.Sprintf("page/%d", i), 0.1)
+		if got > time.Hour || got < 54*time.Minute {
+			t.Fatalf("Jitter = %v, want within 10%% of an hour", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("only %d distinct expiries for 100 keys", len(seen))
+	}
+}
+
+func TestRefreshEarly(t *testing.T) {
+	far := time.Now().Add(24 * time.Hour)
+	if RefreshEarly(time.Now().Add(-time.Second), time.Second, 0) {
+		t.Error("refreshed early with beta 0")
+	}
+	if RefreshEarly(time.Now().Add(-time.Second), 0, 1) {
+		t.Error("refreshed early without a fill time")
+	}
+	if !RefreshEarly(time.Now().Add(-time.Second), time.Second, 1) {
+		t.Error("past expiry was not refreshed")
+	}
+	for range 100 {
+		if RefreshEarly(far, time.Millisecond, 1) {
+			t.Fatal("refreshed a day ahead of expiry")
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	meta := map[string]string{FillMetaKey: FormatFill(1500 * time.Millisecond)}
+	if got := ParseFill(meta); got != 1500*time.Millisecond {
+		t.Errorf("ParseFill = %v", got)
+	}
+	if got := ParseFill(nil); got != 0 {
+		t.Errorf("ParseFill(nil) = %v", got)
+	}
+}
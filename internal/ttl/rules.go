@@ -0,0 +1,144 @@
+// Package ttl decides how long a cached page stays fresh.
+package ttl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetaKey is the object metadata entry recording the TTL a page was stored
+// with. Expiry always uses the current rules; the recorded value only shows
+// which rule applied at the time, in the admin API's title lookups.
+const MetaKey = "ttl"
+
+// Rule sets the TTL of the pages it matches. Every field that is set must
+// match; Namespace matches titles starting with "<Namespace>:". A TTL of zero
+// means pages never expire.
+type Rule struct {
+	Namespace  string `json:"namespace,omitempty"`
+	Title      string `json:"title,omitempty"`
+	TitleRegex string `json:"title_regex,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	TTLSeconds int    `json:"ttl_seconds"`
+
+	re *regexp.Regexp
+}
+
+// Rules picks the TTL of the first matching rule, or the default TTL when
+// none matches.
+type Rules struct {
+	rules []Rule
+	def   time.Duration
+}
+
+// New validates rules. Titles use underscores like page keys do; spaces are
+// replaced.
+func New(rules []Rule, def time.Duration) (*Rules, error) {
+	out := &Rules{def: def}
+	for i, rule := range rules {
+		if rule.TTLSeconds < 0 {
+			return nil, fmt.Errorf("ttl rule %d: ttl_seconds must not be negative", i)
+		}
+		if rule.Namespace == "" && rule.Title == "" && rule.TitleRegex == "" && rule.Variant == "" {
+			return nil, fmt.Errorf("ttl rule %d matches every page", i)
+		}
+		rule.Namespace = strings.ReplaceAll(rule.Namespace, " ", "_")
+		rule.Title = strings.ReplaceAll(rule.Title, " ", "_")
+		if rule.TitleRegex != "" {
+			re, err := regexp.Compile(rule.TitleRegex)
+			if err != nil {
+				return nil, fmt.Errorf("ttl rule %d: %w", i, err)
+			}
+			rule.re = re
+		}
+		out.rules = append(out.rules, rule)
+	}
+	return out, nil
+}
+
+// Load reads a JSON array of rules from path.
+func Load(path string, def time.Duration) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return New(rules, def)
+}
+
+// TTL returns how long the page stays fresh after it was stored.
+func (r *Rules) TTL(variant, title string) time.Duration {
+	for _, rule := range r.rules {
+		if rule.matches(variant, title) {
+			return time.Duration(rule.TTLSeconds) * time.Second
+		}
+	}
+	return r.def
+}
+
+// Max returns the longest TTL any page can get, or zero if some pages never
+// expire.
+func (r *Rules) Max() time.Duration {
+	longest := r.def
+	if longest <= 0 {
+		return 0
+	}
+	for _, rule := range r.rules {
+		ttl := time.Duration(rule.TTLSeconds) * time.Second
+		if ttl <= 0 {
+			return 0
+		}
+		longest = max(longest, ttl)
+	}
+	return longest
+}
+
+// Expired reports whether a page stored at updatedAt is past ttl. Objects
+// without a timestamp are always expired.
+func Expired(updatedAt time.Time, ttl time.Duration) bool {
+	if updatedAt.IsZero() {
+		return true
+	}
+	if ttl <= 0 {
+		return false
+	}
+	return updatedAt.Add(ttl).Before(time.Now())
+}
+
+// FormatMeta returns the MetaKey value for ttl.
+func FormatMeta(ttl time.Duration) string {
+	return strconv.FormatInt(int64(ttl/time.Second), 10)
+}
+
+// ParseMeta reads a MetaKey value. ok is false for pages stored without one.
+func ParseMeta(meta map[string]string) (ttl time.Duration, ok bool) {
+	s, err := strconv.ParseInt(meta[MetaKey], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+func (rule Rule) matches(variant, title string) bool {
+	if rule.Variant != "" && rule.Variant != variant {
+		return false
+	}
+	if rule.Namespace != "" && !strings.HasPrefix(title, rule.Namespace+":") {
+		return false
+	}
+	if rule.Title != "" && rule.Title != title {
+		return false
+	}
+	if rule.re != nil && !rule.re.MatchString(title) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package ttl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRulesTTL(t *testing.T) {
+	rules, err := New([]Rule{
+		{Title: "Main Page", TTLSeconds: 3600},
+		{Namespace: "Template", TTLSeconds: 0},
+		{TitleRegex: `^宝可梦新闻/`, TTLSeconds: 7200},
+		{Variant: "zh-hant", Namespace: "Category", TTLSeconds: 60},
+	}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		variant, title string
+		want           time.Duration
+	}{
+		{"zh", "Main_Page", time.Hour},
+		{"zh-hans", "Main_Page", time.Hour},
+		{"zh", "Template:Infobox", 0},
+		{"zh", "宝可梦新闻/2024", 2 * time.Hour},
+		{"zh-hant", "Category:宝可梦", time.Minute},
+		{"zh", "Category:宝可梦", 24 * time.Hour},
+		{"zh", "皮卡丘", 24 * time.Hour},
+	} {
+		if got := rules.TTL(tt.variant, tt.title); got != tt.want {
+			t.Errorf("TTL(%q, %q) = %v, want %v", tt.variant, tt.title, got, tt.want)
+		}
+	}
+	if got := rules.Max(); got != 0 {
+		t.Errorf("Max with a never-expiring rule = %v, want 0", got)
+	}
+}
+
+func TestRulesMax(t *testing.T) {
+	rules, err := New([]Rule{{Title: "Main_Page", TTLSeconds: 7 * 86400}}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Max(); got != 7*24*time.Hour {
+		t.Errorf("Max = %v", got)
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{TTLSeconds: 60},
+		{Title: "Main_Page", TTLSeconds: -1},
+		{TitleRegex: "(", TTLSeconds: 60},
+	} {
+		if _, err := New([]Rule{rule}, time.Hour); err == nil {
+			t.Errorf("New accepted %+v", rule)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ttl.json")
+	data := `[{"namespace": "News", "ttl_seconds": 600}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Load(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.TTL("zh", "News:Today"); got != 10*time.Minute {
+		t.Errorf("TTL = %v", got)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	meta := map[string]string{MetaKey: FormatMeta(90 * time.Minute)}
+	if got, ok := ParseMeta(meta); !ok || got != 90*time.Minute {
+		t.Errorf("ParseMeta = %v, %v", got, ok)
+	}
+	if _, ok := ParseMeta(nil); ok {
+		t.Error("ParseMeta(nil) found a TTL")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	if !Expired(time.Time{}, time.Hour) {
+		t.Error("object without timestamp is fresh")
+	}
+	if Expired(now.Add(-time.Hour), 0) {
+		t.Error("object with a zero TTL expired")
+	}
+	if !Expired(now.Add(-2*time.Hour), time.Hour) {
+		t.Error("old object is fresh")
+	}
+	if Expired(now.Add(-time.Minute), time.Hour) {
+		t.Error("recent object expired")
+	}
+}